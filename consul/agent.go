@@ -25,75 +25,135 @@ func (r *Client) AgentServices(environmentUUID string) (services map[string]*con
 	return services, nil
 }
 
-func (r *Client) SyncAgentServices(environmentUUID string, rancherNodes map[string]*consulapi.CatalogNode) {
+// PlanAgentServices computes the changes needed to sync the services of the
+// local agent with the ones in Rancher. With nil rancherNodes every service is
+// deregistered right away, regardless of grace periods.
+func (r *Client) PlanAgentServices(environmentUUID string, rancherNodes map[string]*consulapi.CatalogNode, rancherChecks Checks, rancherMeta Meta) (*Plan, error) {
 
 	agentServices, err := r.AgentServices(environmentUUID)
 	if err != nil {
-		logrus.Errorf("Error while getting services from Consul: %v", err)
-		return
+		return nil, err
 	}
 
-	for _, n := range rancherNodes {
-		if reflect.DeepEqual(agentServices, n.Services) {
-			logrus.Info("Everything is in sync")
-			continue
+	// The local agent runs the checks itself, their status is not ours to set
+	services := make(map[string]*consulapi.AgentService)
+	checks := make(map[string]consulapi.AgentServiceChecks)
+	meta := make(map[string]map[string]string)
+	for nk, n := range rancherNodes {
+		for k, s := range n.Services {
+			services[k] = s
+			checks[k] = withoutStatus(rancherChecks[nk][k])
+			meta[k] = rancherMeta[nk][k]
 		}
+	}
 
-		// Check services registered in Consul
-		for k, s := range agentServices {
-			if reflect.DeepEqual(s, n.Services[k]) {
-				delete(n.Services, k)
-				continue
-			}
+	plan := &Plan{RegisteredServices: len(agentServices)}
 
-			//- deregister service
-			if n.Services[k] == nil {
-				err := r.deregisterAgentService(s)
-				if err != nil {
-					logrus.Errorf("Error while deregistering %s: %v", s.ID, err)
-				}
-			} else {
-				err := r.registerAgentService(n.Services[k])
-				if err != nil {
-					logrus.Errorf("Error while registering %s: %v", s.ID, err)
-				}
-				delete(n.Services, k)
+	// Check services registered in Consul
+	sw := newSweep(plan)
+	for k, s := range agentServices {
+		if services[k] == nil {
+			if rancherNodes == nil || !r.missing(sw, nil, s) {
+				plan.DeregisterServices = append(plan.DeregisterServices, &ServiceChange{Service: s})
 			}
+		} else if !reflect.DeepEqual(s, services[k]) || r.checksChanged("", k, checks[k]) || r.metaChanged("", k, meta[k]) {
+			plan.UpdateServices = append(plan.UpdateServices, &ServiceChange{Service: services[k], Checks: checks[k], Meta: meta[k]})
 		}
+	}
 
-		// Check public services registered in Rancher
-		for k, s := range n.Services {
-			if reflect.DeepEqual(s, agentServices[k]) {
-				continue
-			}
+	// Check public services registered in Rancher
+	for k, s := range services {
+		if _, ok := agentServices[k]; !ok {
+			plan.RegisterServices = append(plan.RegisterServices, &ServiceChange{Service: s, Checks: checks[k], Meta: meta[k]})
+		}
+	}
 
-			err := r.registerAgentService(s)
-			if err != nil {
-				logrus.Errorf("Error while registering %s: %v", s.ID, err)
-			}
+	r.pruneTombstones(sw)
+	plan.sort()
+
+	return plan, nil
+}
+
+// ApplyAgentPlan registers and deregisters the services of the plan to the
+// local agent, returning the number of successful operations and an
+// *ApplyError listing the failed ones
+func (r *Client) ApplyAgentPlan(plan *Plan) (registered int, deregistered int, err error) {
+
+	if plan.Empty() {
+		logrus.Info("Everything is in sync")
+		return 0, 0, nil
+	}
+
+	failed := &ApplyError{}
+
+	for _, c := range plan.DeregisterServices {
+		err := r.deregisterAgentService(c.Service)
+		if err != nil {
+			failed.add(err, "Error while deregistering %s", c.Service.ID)
+		} else {
+			deregistered++
 		}
 	}
+
+	for _, c := range append(plan.RegisterServices, plan.UpdateServices...) {
+		err := r.registerAgentService(c.Service, c.Checks, c.Meta)
+		if err != nil {
+			failed.add(err, "Error while registering %s", c.Service.ID)
+		} else {
+			registered++
+		}
+	}
+
+	return registered, deregistered, failed.err()
 }
 
-func (r *Client) registerAgentService(service *consulapi.AgentService) (err error) {
+func (r *Client) registerAgentService(service *consulapi.AgentService, checks consulapi.AgentServiceChecks, meta map[string]string) (err error) {
 
 	logrus.Infof("Registering service %s", service.ID)
 
-	return r.Client.Agent().ServiceRegister(
-		&consulapi.AgentServiceRegistration{
-			ID:                service.ID,
-			Name:              service.Service,
-			Tags:              service.Tags,
-			Port:              service.Port,
-			Address:           service.Address,
-			EnableTagOverride: service.EnableTagOverride,
+	_, err = r.Client.Raw().Write("/v1/agent/service/register",
+		&agentServiceRegistration{
+			AgentServiceRegistration: &consulapi.AgentServiceRegistration{
+				ID:                service.ID,
+				Name:              service.Service,
+				Tags:              service.Tags,
+				Port:              service.Port,
+				Address:           service.Address,
+				EnableTagOverride: service.EnableTagOverride,
+				Checks:            checks,
+			},
+			Meta: meta,
 		},
+		nil, nil,
 	)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range r.staleCheckIDs("", service.ID, checks) {
+		err = r.Client.Agent().CheckDeregister(id)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.setChecks("", service.ID, checks)
+	r.setMeta("", service.ID, meta)
+
+	return nil
 }
 
 func (r *Client) deregisterAgentService(service *consulapi.AgentService) (err error) {
 
 	logrus.Infof("Deregistering agent service %s", service.ID)
 
-	return r.Client.Agent().ServiceDeregister(service.ID)
+	err = r.Client.Agent().ServiceDeregister(service.ID)
+	if err != nil {
+		return err
+	}
+
+	r.setChecks("", service.ID, nil)
+	r.setMeta("", service.ID, nil)
+
+	return nil
 }
@@ -2,29 +2,76 @@ package consul
 
 import (
 	"reflect"
+	"sync"
 
 	"github.com/Sirupsen/logrus"
 	consulapi "github.com/hashicorp/consul/api"
 )
 
-func (r *Client) SyncCatalog(nodes map[string]*consulapi.CatalogNode, rancherNodes map[string]*consulapi.CatalogNode) {
+// PlanCatalog computes the changes needed to sync the nodes in the Consul
+// catalog with the ones in Rancher. With nil rancherNodes every node is
+// deregistered right away, regardless of grace periods.
+func (r *Client) PlanCatalog(nodes map[string]*consulapi.CatalogNode, rancherNodes map[string]*consulapi.CatalogNode, rancherChecks Checks, rancherMeta Meta) *Plan {
 
-	if reflect.DeepEqual(nodes, rancherNodes) {
-		logrus.Info("Everything is in sync")
-		return
+	plan := &Plan{rancherNodes: rancherNodes}
+	sw := newSweep(plan)
+
+	// Services gone from Rancher are kept during their grace period
+	gone := func(node *consulapi.Node, s *consulapi.AgentService) bool {
+		return rancherNodes == nil || !r.missing(sw, node, s)
 	}
 
 	// Compare nodes in Consul with the ones in Rancher
 	for k, n := range nodes {
-		if _, ok := rancherNodes[k]; !ok {
-			// Node doesn't exists in Rancher, deregistering it
-			_, err := r.deregisterCatalogNode(n.Node)
-			if err != nil {
-				logrus.Errorf("Error while deregistering node '%s': %v", n.Node.Node, err)
+		plan.RegisteredServices += len(n.Services)
+
+		rancherNode, ok := rancherNodes[k]
+		if !ok {
+			var expired []*consulapi.AgentService
+			for _, s := range n.Services {
+				if gone(n.Node, s) {
+					expired = append(expired, s)
+				}
+			}
+
+			if r.shared[n.Node.Node] || len(expired) < len(n.Services) {
+				// Node doesn't exists in Rancher but holds services of others
+				// or kept ones, deregistering only our expired services
+				for _, s := range expired {
+					plan.DeregisterServices = append(plan.DeregisterServices, &ServiceChange{Node: n.Node, Service: s})
+				}
+			} else {
+				// Node doesn't exists in Rancher, deregistering it
+				plan.DeregisterNodes = append(plan.DeregisterNodes, n.Node)
+				for _, s := range n.Services {
+					plan.nodeServices = append(plan.nodeServices, &ServiceChange{Node: n.Node, Service: s})
+				}
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(n.Node, rancherNode.Node) {
+			plan.UpdateNodes = append(plan.UpdateNodes, rancherNode.Node)
+		}
+
+		// Check services registered in Consul
+		checks, meta := rancherChecks[k], rancherMeta[k]
+		for id, s := range n.Services {
+			rancherService := rancherNode.Services[id]
+			if rancherService == nil {
+				if gone(n.Node, s) {
+					plan.DeregisterServices = append(plan.DeregisterServices, &ServiceChange{Node: n.Node, Service: s})
+				}
+			} else if !reflect.DeepEqual(s, rancherService) || r.checksChanged(n.Node.Node, id, checks[id]) || r.metaChanged(n.Node.Node, id, meta[id]) {
+				plan.UpdateServices = append(plan.UpdateServices, &ServiceChange{Node: rancherNode.Node, Service: rancherService, Checks: checks[id], Meta: meta[id]})
+			}
+		}
+
+		// Check public services registered in Rancher
+		for id, s := range rancherNode.Services {
+			if _, ok := n.Services[id]; !ok {
+				plan.RegisterServices = append(plan.RegisterServices, &ServiceChange{Node: rancherNode.Node, Service: s, Checks: checks[id], Meta: meta[id]})
 			}
-		} else if !reflect.DeepEqual(n, rancherNodes[k]) {
-			// Node exists in Rancher, update services if necessary
-			r.syncCatalogNode(n, rancherNodes[k])
 		}
 	}
 
@@ -32,122 +79,209 @@ func (r *Client) SyncCatalog(nodes map[string]*consulapi.CatalogNode, rancherNod
 	for k, n := range rancherNodes {
 		// Node doesn't exists in Consul, registering it
 		if _, ok := nodes[k]; !ok {
-			r.registerCatalogNode(n)
+			plan.RegisterNodes = append(plan.RegisterNodes, n.Node)
+			for id, s := range n.Services {
+				plan.RegisterServices = append(plan.RegisterServices, &ServiceChange{Node: n.Node, Service: s, Checks: rancherChecks[k][id], Meta: rancherMeta[k][id]})
+			}
 		}
 	}
+
+	r.pruneTombstones(sw)
+	plan.sort()
+
+	return plan
 }
 
-func (r *Client) syncCatalogNode(node *consulapi.CatalogNode, rancherNode *consulapi.CatalogNode) {
+// ApplyCatalogPlan registers and deregisters the nodes and services of the
+// plan in the catalog, returning the number of successful operations and an
+// *ApplyError listing the failed ones
+func (r *Client) ApplyCatalogPlan(plan *Plan) (registered int, deregistered int, err error) {
 
-	if reflect.DeepEqual(node, rancherNode) {
-		return
-	}
+	r.setDesired(plan)
+	defer r.setApplying(false)
 
-	logrus.Infof("Syncing node %s", node.Node.Node)
+	if plan.Empty() {
+		logrus.Info("Everything is in sync")
+		return 0, 0, nil
+	}
 
-	if !reflect.DeepEqual(node.Node, rancherNode.Node) {
-		r.Client.Catalog().Register(
-			&consulapi.CatalogRegistration{
-				ID:              rancherNode.Node.ID,
-				Node:            rancherNode.Node.Node,
-				Address:         rancherNode.Node.Address,
-				TaggedAddresses: rancherNode.Node.TaggedAddresses,
-			},
-			&consulapi.WriteOptions{},
-		)
+	if r.supportsCatalogTxn() {
+		return r.applyCatalogPlanTxn(plan)
 	}
 
-	// Check services registered in Consul
-	for k, s := range node.Services {
-		if reflect.DeepEqual(s, rancherNode.Services[k]) {
-			delete(rancherNode.Services, k)
-			continue
-		}
+	failed := &ApplyError{}
 
-		//- deregister service
-		if rancherNode.Services[k] == nil {
-			_, err := r.deregisterCatalogService(node.Node, s)
-			if err != nil {
-				logrus.Errorf("Error while deregistering %s: %v", s.ID, err)
-			}
-		} else {
-			_, err := r.registerCatalogService(node.Node, rancherNode.Services[k])
-			if err != nil {
-				logrus.Errorf("Error while registering %s: %v", s.ID, err)
-			}
-			delete(rancherNode.Services, k)
+	var mu sync.Mutex
+	done := func(err error, counter *int, format string, args ...interface{}) {
+		if err != nil {
+			failed.add(err, format, args...)
+			return
 		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		*counter++
 	}
 
-	// Check public services registered in Rancher
-	for k, s := range rancherNode.Services {
-		if reflect.DeepEqual(s, node.Services[k]) {
-			continue
-		}
+	// Nodes are synced concurrently, the operations on each one in order
+	ops := newNodeOps()
 
-		_, err := r.registerCatalogService(node.Node, s)
-		if err != nil {
-			logrus.Errorf("Error while registering %s: %v", s.ID, err)
-		}
+	for _, n := range plan.DeregisterNodes {
+		node := n
+		ops.add(node.Node, func() {
+			_, err := r.deregisterCatalogNode(node)
+			done(err, &deregistered, "Error while deregistering node '%s'", node.Node)
+		})
 	}
-}
 
-func (r *Client) registerCatalogNode(node *consulapi.CatalogNode) {
+	for _, c := range plan.DeregisterServices {
+		change := c
+		ops.add(change.Node.Node, func() {
+			_, err := r.deregisterCatalogService(change.Node, change.Service)
+			done(err, &deregistered, "Error while deregistering %s", change.Service.ID)
+		})
+	}
 
-	logrus.Infof("Registering node %s", node.Node.Node)
+	for _, n := range append(plan.RegisterNodes, plan.UpdateNodes...) {
+		node := n
+		ops.add(node.Node, func() {
+			_, err := r.registerCatalogNode(node)
+			done(err, &registered, "Error while registering node '%s'", node.Node)
+		})
+	}
 
-	for _, s := range node.Services {
-		_, err := r.registerCatalogService(node.Node, s)
-		if err != nil {
-			logrus.Errorf("Error while registering %s: %v", s.ID, err)
-		}
+	for _, c := range append(plan.RegisterServices, plan.UpdateServices...) {
+		change := c
+		ops.add(change.Node.Node, func() {
+			_, err := r.registerCatalogService(change.Node, change.Service, change.Checks, change.Meta)
+			done(err, &registered, "Error while registering %s", change.Service.ID)
+		})
 	}
+
+	parallel(r.Parallelism, ops.jobs())
+
+	return registered, deregistered, failed.err()
+}
+
+func (r *Client) registerCatalogNode(node *consulapi.Node) (wm *consulapi.WriteMeta, err error) {
+
+	logrus.Infof("Registering node %s", node.Node)
+
+	return r.Client.Catalog().Register(
+		&consulapi.CatalogRegistration{
+			ID:              node.ID,
+			Node:            node.Node,
+			Address:         node.Address,
+			TaggedAddresses: node.TaggedAddresses,
+			NodeMeta:        node.Meta,
+		},
+		&consulapi.WriteOptions{},
+	)
 }
 
 func (r *Client) deregisterCatalogNode(node *consulapi.Node) (wm *consulapi.WriteMeta, err error) {
 
 	logrus.Infof("Deregistering node %s", node.Node)
 
-	return r.Client.Catalog().Deregister(
+	wm, err = r.Client.Catalog().Deregister(
 		&consulapi.CatalogDeregistration{
 			Node: node.Node,
 		},
 		&consulapi.WriteOptions{},
 	)
+	if err != nil {
+		return wm, err
+	}
+
+	r.forgetNodeChecks(node.Node)
+
+	return wm, nil
 }
 
-func (r *Client) registerCatalogService(node *consulapi.Node, service *consulapi.AgentService) (wm *consulapi.WriteMeta, err error) {
+func (r *Client) registerCatalogService(node *consulapi.Node, service *consulapi.AgentService, checks consulapi.AgentServiceChecks, meta map[string]string) (wm *consulapi.WriteMeta, err error) {
 
 	logrus.Infof("Registering service %s on %s", service.ID, node.Node)
 
-	return r.Client.Catalog().Register(
-		&consulapi.CatalogRegistration{
-			ID:              node.ID,
-			Node:            node.Node,
-			Address:         node.Address,
-			TaggedAddresses: node.TaggedAddresses,
-			Service: &consulapi.AgentService{
-				ID:                service.ID,
-				Service:           service.Service,
-				Tags:              service.Tags,
-				Port:              service.Port,
-				Address:           service.Address,
-				EnableTagOverride: service.EnableTagOverride,
+	wm, err = r.Client.Raw().Write("/v1/catalog/register",
+		&catalogRegistration{
+			CatalogRegistration: &consulapi.CatalogRegistration{
+				ID:              node.ID,
+				Node:            node.Node,
+				Address:         node.Address,
+				TaggedAddresses: node.TaggedAddresses,
+				NodeMeta:        node.Meta,
+			},
+			Service: &agentService{
+				AgentService: &consulapi.AgentService{
+					ID:                service.ID,
+					Service:           service.Service,
+					Tags:              service.Tags,
+					Port:              service.Port,
+					Address:           service.Address,
+					EnableTagOverride: service.EnableTagOverride,
+				},
+				Meta: meta,
 			},
 		},
-		&consulapi.WriteOptions{},
+		nil, &consulapi.WriteOptions{},
 	)
+	if err != nil {
+		return wm, err
+	}
+
+	for _, id := range r.staleCheckIDs(node.Node, service.ID, checks) {
+		wm, err = r.Client.Catalog().Deregister(
+			&consulapi.CatalogDeregistration{
+				Node:    node.Node,
+				CheckID: id,
+			},
+			&consulapi.WriteOptions{},
+		)
+		if err != nil {
+			return wm, err
+		}
+	}
+
+	for _, check := range catalogChecks(node, service, checks) {
+		wm, err = r.Client.Catalog().Register(
+			&consulapi.CatalogRegistration{
+				ID:              node.ID,
+				Node:            node.Node,
+				Address:         node.Address,
+				TaggedAddresses: node.TaggedAddresses,
+				NodeMeta:        node.Meta,
+				Check:           check,
+			},
+			&consulapi.WriteOptions{},
+		)
+		if err != nil {
+			return wm, err
+		}
+	}
+
+	r.setChecks(node.Node, service.ID, checks)
+	r.setMeta(node.Node, service.ID, meta)
+
+	return wm, nil
 }
 
 func (r *Client) deregisterCatalogService(node *consulapi.Node, service *consulapi.AgentService) (wm *consulapi.WriteMeta, err error) {
 
 	logrus.Infof("Deregistering service %s on %s", service.ID, node.Node)
 
-	return r.Client.Catalog().Deregister(
+	wm, err = r.Client.Catalog().Deregister(
 		&consulapi.CatalogDeregistration{
 			Node:      node.Node,
 			ServiceID: service.ID,
 		},
 		&consulapi.WriteOptions{},
 	)
+	if err != nil {
+		return wm, err
+	}
+
+	r.setChecks(node.Node, service.ID, nil)
+	r.setMeta(node.Node, service.ID, nil)
+
+	return wm, nil
 }
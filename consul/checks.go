@@ -0,0 +1,261 @@
+package consul
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/waynz0r/rancher-consul-registrator/metadata"
+)
+
+const (
+	defaultCheckInterval = 10 * time.Second
+)
+
+// Checks holds the health checks of the services keyed by node address and service ID
+type Checks map[string]map[string]consulapi.AgentServiceChecks
+
+// serviceChecks returns the checks of the service: a TTL check mirroring the
+// health state of the container followed by its Rancher health check
+func serviceChecks(s metadata.Service, opts *ConvertOptions) (checks consulapi.AgentServiceChecks) {
+
+	if s.ContainerUUID != "" && opts.HealthTTL > 0 {
+		checks = append(checks, healthStateCheck(s, opts.HealthTTL))
+	}
+
+	// Rancher health checks are HTTP or TCP only
+	if s.HealthCheck != nil && s.Protocol != "udp" {
+		checks = append(checks, rancherHealthCheck(s))
+	}
+
+	return checks
+}
+
+// healthStateCheck returns a TTL check whose status follows the health state
+// Rancher reports for the container
+func healthStateCheck(s metadata.Service, ttl time.Duration) *consulapi.AgentServiceCheck {
+
+	return &consulapi.AgentServiceCheck{
+		TTL:    ttl.String(),
+		Status: checkStatus(s.HealthState),
+		Notes:  "Rancher container health state",
+	}
+}
+
+// rancherHealthCheck converts the Rancher health check of the service into
+// a Consul HTTP or TCP check. Consul has no notion of healthy/unhealthy
+// thresholds, so those are not carried over.
+func rancherHealthCheck(s metadata.Service) *consulapi.AgentServiceCheck {
+
+	hc := s.HealthCheck
+
+	// Prefer the registered port, the container IP might not be routable from the agent
+	address := s.ContainerIP + ":" + strconv.Itoa(hc.Port)
+	if hc.Port == s.PrivatePort {
+		address = s.ServiceAddress() + ":" + strconv.Itoa(s.Port)
+	}
+
+	interval := defaultCheckInterval
+	if hc.Interval > 0 {
+		interval = time.Duration(hc.Interval) * time.Millisecond
+	}
+
+	check := &consulapi.AgentServiceCheck{
+		Interval: interval.String(),
+		Status:   checkStatus(s.HealthState),
+		Notes:    "Rancher health check",
+	}
+
+	if hc.ResponseTimeout > 0 {
+		check.Timeout = (time.Duration(hc.ResponseTimeout) * time.Millisecond).String()
+	}
+
+	// Request line looks like GET "/healthcheck" "HTTP/1.0"
+	if fields := strings.Fields(hc.RequestLine); len(fields) >= 2 {
+		check.HTTP = "http://" + address + strings.Trim(fields[1], "\"")
+	} else {
+		check.TCP = address
+	}
+
+	return check
+}
+
+// checkStatus maps a Rancher container health state to a Consul check status
+func checkStatus(healthState string) string {
+
+	switch healthState {
+	case "", "healthy", "updating-healthy":
+		return "passing"
+	case "initializing", "reinitializing":
+		return "warning"
+	}
+
+	return "critical"
+}
+
+// checkOutput describes the status of a health state check
+func checkOutput(status string) string {
+
+	switch status {
+	case "passing":
+		return "Container is healthy"
+	case "warning":
+		return "Container is initializing"
+	}
+
+	return "Container is unhealthy"
+}
+
+// withoutStatus returns a copy of the checks with their status cleared
+func withoutStatus(checks consulapi.AgentServiceChecks) consulapi.AgentServiceChecks {
+
+	if len(checks) == 0 {
+		return nil
+	}
+
+	result := make(consulapi.AgentServiceChecks, 0, len(checks))
+	for _, check := range checks {
+		c := *check
+		c.Status = ""
+		result = append(result, &c)
+	}
+
+	return result
+}
+
+// catalogChecks converts service checks to catalog checks of the given node
+func catalogChecks(node *consulapi.Node, service *consulapi.AgentService, checks consulapi.AgentServiceChecks) (result []*consulapi.AgentCheck) {
+
+	for i, check := range checks {
+		name := "Service '" + service.Service + "' check"
+		output := "TCP " + check.TCP
+		if check.HTTP != "" {
+			output = "HTTP GET " + check.HTTP
+		} else if check.TTL != "" {
+			name = "Service '" + service.Service + "' health state"
+			output = checkOutput(check.Status)
+		}
+
+		result = append(result, &consulapi.AgentCheck{
+			Node:        node.Node,
+			CheckID:     serviceCheckID(service.ID, i, len(checks)),
+			Name:        name,
+			Status:      check.Status,
+			Notes:       check.Notes,
+			Output:      output,
+			ServiceID:   service.ID,
+			ServiceName: service.Service,
+		})
+	}
+
+	return result
+}
+
+// UpdateTTLChecks reports the status of the TTL checks of the services to
+// the local agent
+func (r *Client) UpdateTTLChecks(checks Checks) {
+
+	for _, nodeChecks := range checks {
+		for k, serviceChecks := range nodeChecks {
+			for i, check := range serviceChecks {
+				if check.TTL == "" {
+					continue
+				}
+
+				id := serviceCheckID(k, i, len(serviceChecks))
+				err := r.Client.Agent().UpdateTTL(id, checkOutput(check.Status), check.Status)
+				if err != nil {
+					logrus.Errorf("Error while updating check %s: %v", id, err)
+				}
+			}
+		}
+	}
+}
+
+// serviceCheckID mimics the IDs the Consul agent gives to the checks of a service
+func serviceCheckID(serviceID string, i int, count int) string {
+
+	if count > 1 {
+		return "service:" + serviceID + ":" + strconv.Itoa(i+1)
+	}
+
+	return "service:" + serviceID
+}
+
+// staleCheckIDs returns the IDs of the checks registered last time for the
+// service on the node that are not part of the given checks anymore
+func (r *Client) staleCheckIDs(node string, serviceID string, checks consulapi.AgentServiceChecks) (ids []string) {
+	r.fingerprints.Lock()
+	defer r.fingerprints.Unlock()
+
+	var registered consulapi.AgentServiceChecks
+	if fp, ok := r.checks[node+"/"+serviceID]; ok {
+		json.Unmarshal([]byte(fp), &registered)
+	}
+
+	current := make(map[string]bool)
+	for i := range checks {
+		current[serviceCheckID(serviceID, i, len(checks))] = true
+	}
+
+	for i := range registered {
+		if id := serviceCheckID(serviceID, i, len(registered)); !current[id] {
+			ids = append(ids, id)
+		}
+	}
+
+	return ids
+}
+
+func checksFingerprint(checks consulapi.AgentServiceChecks) string {
+
+	if len(checks) == 0 {
+		return ""
+	}
+
+	b, _ := json.Marshal(checks)
+
+	return string(b)
+}
+
+// checksChanged reports whether the checks differ from the ones registered
+// last time for the service on the node
+func (r *Client) checksChanged(node string, serviceID string, checks consulapi.AgentServiceChecks) bool {
+	r.fingerprints.Lock()
+	defer r.fingerprints.Unlock()
+
+	return r.checks[node+"/"+serviceID] != checksFingerprint(checks)
+}
+
+func (r *Client) setChecks(node string, serviceID string, checks consulapi.AgentServiceChecks) {
+	r.fingerprints.Lock()
+	defer r.fingerprints.Unlock()
+
+	if fp := checksFingerprint(checks); fp != "" {
+		r.checks[node+"/"+serviceID] = fp
+	} else {
+		delete(r.checks, node+"/"+serviceID)
+	}
+}
+
+// forgetNodeChecks drops what was registered last time for the services of
+// the node, checks and metadata alike
+func (r *Client) forgetNodeChecks(node string) {
+	r.fingerprints.Lock()
+	defer r.fingerprints.Unlock()
+
+	for k := range r.checks {
+		if strings.HasPrefix(k, node+"/") {
+			delete(r.checks, k)
+		}
+	}
+
+	for k := range r.meta {
+		if strings.HasPrefix(k, node+"/") {
+			delete(r.meta, k)
+		}
+	}
+}
@@ -1,11 +1,15 @@
 package consul
 
 import (
+	"fmt"
 	"net/url"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	consulapi "github.com/hashicorp/consul/api"
@@ -16,6 +20,36 @@ import (
 // Client can be used to query Consul API
 type Client struct {
 	Client *consulapi.Client
+
+	// Number of nodes read or synced at the same time in remote mode
+	Parallelism int
+
+	// Services gone from Rancher are kept for their grace period, this one
+	// unless labeled otherwise, with a critical check if asked to
+	DeregisterGrace     time.Duration
+	CriticalDuringGrace bool
+
+	// Services gone from Rancher by node and service ID
+	tombstones map[string]*tombstone
+
+	// Fingerprints of the checks and metadata registered per node and
+	// service ID, nodes are synced concurrently
+	fingerprints sync.Mutex
+	checks       map[string]string
+	meta         map[string]string
+
+	// Whether Consul supports catalog operations in transactions, nil until checked
+	catalogTxn *bool
+
+	// Nodes also holding services the environment doesn't own, as of the
+	// last Nodes call. They are never deregistered as a whole.
+	shared map[string]bool
+
+	// What the catalog should hold once the last plan is applied, for the
+	// catalog watcher
+	mu       sync.Mutex
+	desired  *catalogView
+	applying bool
 }
 
 func NewClient(URL string, token string) *Client {
@@ -50,12 +84,21 @@ func NewClient(URL string, token string) *Client {
 		config.Address = uri.Host
 	}
 
+	if config.HttpClient.Transport != nil {
+		config.HttpClient.Transport = &instrumentedTransport{config.HttpClient.Transport}
+	}
+
 	client, err := consulapi.NewClient(config)
 	if err != nil {
 		logrus.Fatalf("consul: %s", uri.Scheme)
 	}
 
-	return &Client{Client: client}
+	return &Client{
+		Client:     client,
+		checks:     make(map[string]string),
+		meta:       make(map[string]string),
+		tombstones: make(map[string]*tombstone),
+	}
 }
 
 func (r *Client) Ping() (string, error) {
@@ -79,6 +122,70 @@ func (r *Client) Node(node string, q *consulapi.QueryOptions) (n *consulapi.Cata
 	return n, nil
 }
 
+// NodesError lists the nodes Nodes failed to read, the view of the catalog
+// it returns along is incomplete
+type NodesError struct {
+	Errors map[string]error
+}
+
+func (e *NodesError) Error() string {
+
+	names := make([]string, 0, len(e.Errors))
+	for name := range e.Errors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	failures := make([]string, 0, len(names))
+	for _, name := range names {
+		failures = append(failures, name+": "+e.Errors[name].Error())
+	}
+
+	return fmt.Sprintf("cannot read %d Consul nodes: %s", len(names), strings.Join(failures, "; "))
+}
+
+// ApplyError lists the operations of a plan that failed, the others were made
+type ApplyError struct {
+	mu     sync.Mutex
+	Errors []error
+}
+
+func (e *ApplyError) Error() string {
+
+	failures := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		failures = append(failures, err.Error())
+	}
+
+	return fmt.Sprintf("%d Consul operations failed: %s", len(failures), strings.Join(failures, "; "))
+}
+
+// add logs and records the failure of an operation, operations on several
+// nodes are made concurrently
+func (e *ApplyError) add(err error, format string, args ...interface{}) {
+
+	err = fmt.Errorf(format+": %v", append(args, err)...)
+	logrus.Error(err)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.Errors = append(e.Errors, err)
+}
+
+// err returns nil when every operation succeeded
+func (e *ApplyError) err() error {
+
+	if len(e.Errors) == 0 {
+		return nil
+	}
+
+	return e
+}
+
+// Nodes returns the nodes registered for the Rancher environment by address,
+// with the services registered for it. The nodes that cannot be read are left
+// out and reported with a *NodesError.
 func (r *Client) Nodes(environmentUUID string, q *consulapi.QueryOptions) (nodes map[string]*consulapi.CatalogNode, err error) {
 
 	ns, _, err := r.Client.Catalog().Nodes(q)
@@ -86,17 +193,55 @@ func (r *Client) Nodes(environmentUUID string, q *consulapi.QueryOptions) (nodes
 		return nodes, err
 	}
 
+	failed := make(map[string]error)
+
 	nodes = make(map[string]*consulapi.CatalogNode)
+	r.shared = make(map[string]bool)
+
+	// Nodes are read concurrently
+	var mu sync.Mutex
+	var jobs []func()
 
 	for _, node := range ns {
 		// Only get the nodes registered for the selected Rancher environment
-		if isRancherNode(node, environmentUUID) {
-			n, err := r.Node(node.Node, &consulapi.QueryOptions{})
+		if !isRancherNode(node, environmentUUID) {
+			continue
+		}
+
+		name := node.Node
+		jobs = append(jobs, func() {
+			n, err := r.Node(name, &consulapi.QueryOptions{})
 			if err != nil {
-				logrus.Errorf("%v", err)
+				mu.Lock()
+				defer mu.Unlock()
+				failed[name] = err
+				return
 			}
-			nodes[n.Node.Address] = removeNotRancherRegisteredServices(n, environmentUUID)
-		}
+			if n == nil || n.Node == nil {
+				logrus.Debugf("Node %s was deregistered in the meantime", name)
+				return
+			}
+
+			// Nodes without metadata come back with an empty map
+			if len(n.Node.Meta) == 0 {
+				n.Node.Meta = nil
+			}
+			count := len(n.Services)
+			removeNotRancherRegisteredServices(n, environmentUUID)
+
+			mu.Lock()
+			defer mu.Unlock()
+			nodes[n.Node.Address] = n
+			if len(n.Services) < count {
+				r.shared[n.Node.Node] = true
+			}
+		})
+	}
+
+	parallel(r.Parallelism, jobs)
+
+	if len(failed) > 0 {
+		return nodes, &NodesError{Errors: failed}
 	}
 
 	return nodes, nil
@@ -133,44 +278,145 @@ func removeNotRancherRegisteredServices(node *consulapi.CatalogNode, environment
 	return node
 }
 
-func ConvertRancherServices(services []metadata.Service) (nodes map[string]*consulapi.CatalogNode) {
+// ConvertOptions controls how Rancher services are converted to Consul services
+type ConvertOptions struct {
+	// TTL of the checks mirroring the container health states, zero disables them
+	HealthTTL time.Duration
+
+	// Register the port rules of load balancers as services of their own
+	LoadBalancerRules bool
+
+	// Labels and Rancher service metadata keys copied into the service metadata
+	MetaKeys *regexp.Regexp
+
+	// Templates of the service names, IDs, tags and node names, nil for the defaults
+	Templates *Templates
+
+	// Sources of the lan and wan tagged addresses of the nodes, see AddressSources
+	LANAddress string
+	WANAddress string
+}
+
+// AddressSources are the sources the tagged addresses of the nodes can be
+// taken from: the Rancher agent IP, the external_dns_ip label of the host
+// (falling back to the agent IP) or none at all
+var AddressSources = []string{"agent", "external", "none"}
+
+// hostAddress returns the address of the host of the service from source
+func hostAddress(s metadata.Service, source string) string {
+
+	switch source {
+	case "agent":
+		if s.Host != nil && s.Host.AgentIP != "" {
+			return s.Host.AgentIP
+		}
+		return s.IP
+	case "external":
+		if s.Host != nil && s.Host.Labels[metadata.ExternalIPLabel] != "" {
+			return s.Host.Labels[metadata.ExternalIPLabel]
+		}
+		return hostAddress(s, "agent")
+	}
+
+	return ""
+}
+
+func ConvertRancherServices(services []metadata.Service, opts *ConvertOptions) (nodes map[string]*consulapi.CatalogNode, checks Checks, meta Meta) {
 
 	nodes = make(map[string]*consulapi.CatalogNode)
+	checks = make(Checks)
+	meta = make(Meta)
+
+	templates := opts.Templates
+	if templates == nil {
+		templates = &Templates{}
+	}
 
 	for _, s := range services {
+		if serviceIgnored(s) {
+			logrus.Debugf("Ignoring service %s-%s on port %d", s.StackName, s.Name, s.Port)
+			continue
+		}
+
+		data := templateData(s)
+
 		if _, ok := nodes[s.IP]; !ok {
 			cr := &consulapi.CatalogNode{
 				Node: &consulapi.Node{
-					Node:    s.HostName,
+					Node:    execute(templates.NodeName, data, s.HostName),
 					Address: s.IP,
 					TaggedAddresses: map[string]string{
 						sanitizeLabel("rancher-" + s.EnvironmentUUID + "-ip"): s.IP,
-						"wan": s.IP,
 					},
+					Meta: nodeMeta(s),
 				},
 				Services: make(map[string]*consulapi.AgentService, 0),
 			}
+			if lan := hostAddress(s, opts.LANAddress); lan != "" {
+				cr.Node.TaggedAddresses["lan"] = lan
+			}
+			if wan := hostAddress(s, opts.WANAddress); wan != "" {
+				cr.Node.TaggedAddresses["wan"] = wan
+			}
 			nodes[s.IP] = cr
+			checks[s.IP] = make(map[string]consulapi.AgentServiceChecks)
+			meta[s.IP] = make(map[string]map[string]string)
 		}
 
-		serviceName := s.StackName + "-" + s.Name
+		serviceName := serviceNameFromLabels(s, execute(templates.ServiceName, data, s.StackName+"-"+s.Name))
 		serviceID := serviceName + "-" + strconv.Itoa(s.Port)
 
+		// Containers of the same service may share a host and even a port
+		if s.ContainerUUID != "" {
+			serviceID = serviceName + "-" + s.ContainerUUID + "-" + strconv.Itoa(s.Port)
+		}
+
+		// Keep TCP IDs unchanged, other protocols may use the same port numbers
+		if s.Protocol != "" && s.Protocol != "tcp" {
+			serviceID += "-" + s.Protocol
+		}
+
+		data.Name = serviceName
+		serviceID = execute(templates.ServiceID, data, serviceID)
+
+		tags := []string{
+			"created-by-rancher",
+			sanitizeLabel("rancher-" + s.EnvironmentUUID),
+			sanitizeLabel(s.EnvironmentName),
+		}
+		if s.Protocol != "" {
+			tags = append(tags, s.Protocol)
+		}
+		tags = append(tags, templateTags(templates.Tags, data)...)
+
 		nodes[s.IP].Services[serviceID] = &consulapi.AgentService{
 			ID:                serviceID,
 			Service:           serviceName,
 			Port:              s.Port,
-			Address:           s.IP,
+			Address:           s.ServiceAddress(),
 			EnableTagOverride: false,
-			Tags: []string{
-				"created-by-rancher",
-				sanitizeLabel("rancher-" + s.EnvironmentUUID),
-				sanitizeLabel(s.EnvironmentName),
-			},
+			Tags:              append(tags, serviceTagsFromLabels(s)...),
+		}
+
+		if c := serviceChecks(s, opts); len(c) > 0 {
+			checks[s.IP][serviceID] = c
+		}
+		meta[s.IP][serviceID] = serviceMeta(s, opts.MetaKeys)
+
+		if s.Kind != metadata.LoadBalancerKind || !opts.LoadBalancerRules {
+			continue
+		}
+
+		for _, rs := range loadBalancerRuleServices(s, nodes[s.IP].Services[serviceID]) {
+			nodes[s.IP].Services[rs.ID] = rs
+			meta[s.IP][rs.ID] = meta[s.IP][serviceID]
+			if s.ContainerUUID != "" && opts.HealthTTL > 0 {
+				checks[s.IP][rs.ID] = consulapi.AgentServiceChecks{healthStateCheck(s, opts.HealthTTL)}
+			}
 		}
 	}
 
-	return nodes
+	return nodes, checks, meta
 }
 
 func sanitizeLabel(label string) string {
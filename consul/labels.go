@@ -0,0 +1,64 @@
+package consul
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/waynz0r/rancher-consul-registrator/metadata"
+)
+
+const (
+	labelPrefix = "io.consul."
+)
+
+// serviceLabel looks up the io.consul.<port>.<key> label of the service,
+// falling back to io.consul.service.<key>
+func serviceLabel(s metadata.Service, key string) (string, bool) {
+
+	if s.PrivatePort != 0 {
+		if v, ok := s.Labels[labelPrefix+strconv.Itoa(s.PrivatePort)+"."+key]; ok {
+			return v, true
+		}
+	}
+
+	v, ok := s.Labels[labelPrefix+"service."+key]
+
+	return v, ok
+}
+
+func serviceIgnored(s metadata.Service) bool {
+
+	v, ok := serviceLabel(s, "ignore")
+	if !ok {
+		return false
+	}
+
+	ignore, err := strconv.ParseBool(v)
+
+	return err == nil && ignore
+}
+
+func serviceNameFromLabels(s metadata.Service, defaultName string) string {
+
+	if v, ok := serviceLabel(s, "name"); ok && v != "" {
+		return v
+	}
+
+	return defaultName
+}
+
+func serviceTagsFromLabels(s metadata.Service) (tags []string) {
+
+	v, ok := serviceLabel(s, "tags")
+	if !ok {
+		return tags
+	}
+
+	for _, tag := range strings.Split(v, ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
@@ -0,0 +1,47 @@
+package consul
+
+import (
+	"strconv"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/waynz0r/rancher-consul-registrator/metadata"
+)
+
+// loadBalancerRuleServices returns a service for every port rule of the load
+// balancer listening on the port of lbService, named after the target service
+// and tagged with the hostname and path the rule matches
+func loadBalancerRuleServices(s metadata.Service, lbService *consulapi.AgentService) (services []*consulapi.AgentService) {
+
+	for i, rule := range s.PortRules {
+		if rule.SourcePort != s.PrivatePort || rule.Service == "" {
+			continue
+		}
+
+		tags := append([]string{}, lbService.Tags...)
+		tags = append(tags, "lb-rule", "lb="+lbService.Service)
+		if rule.Hostname != "" {
+			tags = append(tags, "hostname="+rule.Hostname)
+		}
+		if rule.Path != "" {
+			tags = append(tags, "path="+rule.Path)
+		}
+		if rule.TargetPort != 0 {
+			tags = append(tags, "target-port="+strconv.Itoa(rule.TargetPort))
+		}
+		if rule.Protocol != "" {
+			tags = append(tags, "lb-protocol="+rule.Protocol)
+		}
+
+		services = append(services, &consulapi.AgentService{
+			ID:                lbService.ID + "-rule-" + strconv.Itoa(i),
+			Service:           strings.Replace(rule.Service, "/", "-", 1) + "-lb",
+			Port:              lbService.Port,
+			Address:           lbService.Address,
+			EnableTagOverride: false,
+			Tags:              tags,
+		})
+	}
+
+	return services
+}
@@ -0,0 +1,77 @@
+package consul
+
+import (
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	lockRetryTime = 5 * time.Second
+)
+
+// LockKey returns the KV key the registrators syncing the given Rancher
+// environment compete for
+func LockKey(environmentUUID string) string {
+	return "rancher-consul-registrator/" + sanitizeLabel(environmentUUID) + "/leader"
+}
+
+// Elect campaigns for the lock on key until stop is closed, calling onChange
+// whenever leadership is acquired or lost and onError whenever campaigning
+// fails. The lock is released on stop.
+func (r *Client) Elect(key string, stop <-chan struct{}, onChange func(leader bool), onError func(err error)) {
+
+	hostname, _ := os.Hostname()
+
+	lock, err := r.Client.LockOpts(&consulapi.LockOptions{
+		Key:            key,
+		Value:          []byte(hostname),
+		SessionName:    "rancher-consul-registrator",
+		MonitorRetries: 3,
+	})
+	if err != nil {
+		logrus.Fatalf("Cannot create Consul lock %s: %v", key, err)
+	}
+
+	for {
+		lost, err := lock.Lock(stop)
+		if err != nil {
+			logrus.Errorf("Error while acquiring lock %s: %v...will retry", key, err)
+			onError(err)
+			select {
+			case <-time.After(lockRetryTime):
+				continue
+			case <-stop:
+				return
+			}
+		}
+
+		// Lock returns without error only when stop is closed while waiting
+		if lost == nil {
+			return
+		}
+
+		logrus.Infof("Acquired lock %s, this instance is now the leader", key)
+		onChange(true)
+
+		select {
+		case <-lost:
+			logrus.Warnf("Lost lock %s, standing by", key)
+			onChange(false)
+
+			// The lock still believes it is held until released, which fails
+			// when the session is gone already
+			if err := lock.Unlock(); err != nil && err != consulapi.ErrLockNotHeld {
+				logrus.Debugf("Error while releasing lost lock %s: %v", key, err)
+			}
+		case <-stop:
+			onChange(false)
+			if err := lock.Unlock(); err != nil {
+				logrus.Errorf("Error while releasing lock %s: %v", key, err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package consul
+
+import (
+	"encoding/json"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/waynz0r/rancher-consul-registrator/metadata"
+)
+
+const (
+	// Limits Consul enforces on service and node metadata
+	maxMetaPairs       = 64
+	maxMetaKeyLength   = 128
+	maxMetaValueLength = 512
+)
+
+var metaKeyInvalidChars = regexp.MustCompile("[^a-zA-Z0-9_-]")
+
+// Meta holds the metadata of the services per node and service ID. The
+// vendored API knows nothing about service metadata, so it is kept apart from
+// the services and registered through the raw API.
+type Meta map[string]map[string]map[string]string
+
+// agentService is an AgentService along with its metadata
+type agentService struct {
+	*consulapi.AgentService
+	Meta map[string]string `json:",omitempty"`
+}
+
+// agentServiceRegistration is an AgentServiceRegistration along with the
+// metadata of the service
+type agentServiceRegistration struct {
+	*consulapi.AgentServiceRegistration
+	Meta map[string]string `json:",omitempty"`
+}
+
+// catalogRegistration is a CatalogRegistration whose service carries its metadata
+type catalogRegistration struct {
+	*consulapi.CatalogRegistration
+	Service *agentService `json:",omitempty"`
+}
+
+// serviceMeta returns the metadata identifying the Rancher objects behind the
+// service, along with the labels and Rancher service metadata whose keys match
+// allowed
+func serviceMeta(s metadata.Service, allowed *regexp.Regexp) map[string]string {
+
+	meta := map[string]string{
+		"rancher_stack":          s.StackName,
+		"rancher_service":        s.Name,
+		"rancher_container_uuid": s.ContainerUUID,
+		"rancher_host_uuid":      s.HostUUID,
+		graceMetaKey:             serviceGrace(s),
+	}
+	for k, v := range meta {
+		if v == "" {
+			delete(meta, k)
+		}
+	}
+
+	if allowed == nil {
+		return meta
+	}
+
+	// Labels are set on the containers as well, they take precedence
+	extra := make(map[string]string)
+	for k, v := range s.Metadata {
+		if !allowed.MatchString(k) {
+			continue
+		}
+		if str, ok := v.(string); ok {
+			extra[k] = str
+		} else if b, err := json.Marshal(v); err == nil {
+			extra[k] = string(b)
+		}
+	}
+	for k, v := range s.Labels {
+		if allowed.MatchString(k) {
+			extra[k] = v
+		}
+	}
+
+	addMeta(meta, extra)
+
+	return meta
+}
+
+// nodeMeta returns the metadata of the node of the Rancher host the service
+// runs on: its ID, capacity, environment and labels
+func nodeMeta(s metadata.Service) map[string]string {
+
+	meta := map[string]string{
+		"rancher_environment": s.EnvironmentName,
+	}
+
+	host := s.Host
+	if host == nil {
+		return meta
+	}
+
+	meta["rancher_host_id"] = strconv.Itoa(host.HostId)
+	meta["rancher_host_uuid"] = host.UUID
+	if host.Memory > 0 {
+		meta["rancher_memory"] = strconv.FormatInt(host.Memory, 10)
+	}
+	if host.MilliCPU > 0 {
+		meta["rancher_milli_cpu"] = strconv.FormatInt(host.MilliCPU, 10)
+	}
+
+	addMeta(meta, host.Labels)
+
+	return meta
+}
+
+// addMeta adds the pairs to meta in key order, with the keys made valid and
+// the values truncated, as long as Consul allows more pairs. Pairs already in
+// meta are kept.
+func addMeta(meta map[string]string, pairs map[string]string) {
+
+	keys := make([]string, 0, len(pairs))
+	for k := range pairs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if len(meta) >= maxMetaPairs {
+			break
+		}
+
+		key := metaKey(k)
+		if key == "" {
+			continue
+		}
+		if _, ok := meta[key]; ok {
+			continue
+		}
+
+		value := pairs[k]
+		if len(value) > maxMetaValueLength {
+			value = value[:maxMetaValueLength]
+		}
+		meta[key] = value
+	}
+}
+
+// metaKey turns a label or metadata key into a valid Consul metadata key
+func metaKey(key string) string {
+
+	key = metaKeyInvalidChars.ReplaceAllString(key, "_")
+	if len(key) > maxMetaKeyLength {
+		key = key[:maxMetaKeyLength]
+	}
+
+	// Keys starting with "consul-" are reserved
+	if strings.HasPrefix(strings.ToLower(key), "consul-") {
+		return ""
+	}
+
+	return key
+}
+
+func metaFingerprint(meta map[string]string) string {
+
+	if len(meta) == 0 {
+		return ""
+	}
+
+	// Maps are encoded with sorted keys
+	b, _ := json.Marshal(meta)
+
+	return string(b)
+}
+
+// metaChanged reports whether the metadata differs from the one registered
+// last time for the service on the node
+func (r *Client) metaChanged(node string, serviceID string, meta map[string]string) bool {
+	r.fingerprints.Lock()
+	defer r.fingerprints.Unlock()
+
+	return r.meta[node+"/"+serviceID] != metaFingerprint(meta)
+}
+
+func (r *Client) setMeta(node string, serviceID string, meta map[string]string) {
+	r.fingerprints.Lock()
+	defer r.fingerprints.Unlock()
+
+	if fp := metaFingerprint(meta); fp != "" {
+		r.meta[node+"/"+serviceID] = fp
+	} else {
+		delete(r.meta, node+"/"+serviceID)
+	}
+}
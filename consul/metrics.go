@@ -0,0 +1,50 @@
+package consul
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/waynz0r/rancher-consul-registrator/metrics"
+)
+
+var (
+	requestDuration = metrics.NewHistogram(
+		"rancher_consul_registrator_consul_request_duration_seconds",
+		"Latency of the requests to the Consul API",
+		metrics.DefaultBuckets,
+		"method", "endpoint",
+	)
+)
+
+// instrumentedTransport measures the latency of the requests to Consul.
+// Blocking queries, e.g. of the catalog watcher or the leader lock, are left
+// out, they wait for changes on purpose.
+type instrumentedTransport struct {
+	http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	if req.URL.Query().Get("index") != "" {
+		return t.RoundTripper.RoundTrip(req)
+	}
+
+	start := time.Now()
+	resp, err := t.RoundTripper.RoundTrip(req)
+	requestDuration.Observe(time.Since(start).Seconds(), req.Method, endpoint(req.URL.Path))
+
+	return resp, err
+}
+
+// endpoint trims the path to its first three segments (e.g. /v1/catalog/node)
+// so node names and service IDs don't end up in metric labels
+func endpoint(path string) string {
+
+	parts := strings.SplitN(path, "/", 5)
+	if len(parts) > 4 {
+		parts = parts[:4]
+	}
+
+	return strings.Join(parts, "/")
+}
@@ -0,0 +1,137 @@
+package consul
+
+import (
+	"encoding/json"
+	"sort"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// ServiceChange is a service to be (de)registered, along with its checks
+type ServiceChange struct {
+	Node    *consulapi.Node              `json:"node,omitempty"`
+	Service *consulapi.AgentService      `json:"service"`
+	Checks  consulapi.AgentServiceChecks `json:"checks,omitempty"`
+	Meta    map[string]string            `json:"meta,omitempty"`
+}
+
+// Plan holds the changes needed to bring Consul in sync with Rancher
+type Plan struct {
+	RegisterNodes      []*consulapi.Node `json:"register_nodes,omitempty"`
+	UpdateNodes        []*consulapi.Node `json:"update_nodes,omitempty"`
+	DeregisterNodes    []*consulapi.Node `json:"deregister_nodes,omitempty"`
+	RegisterServices   []*ServiceChange  `json:"register_services,omitempty"`
+	UpdateServices     []*ServiceChange  `json:"update_services,omitempty"`
+	DeregisterServices []*ServiceChange  `json:"deregister_services,omitempty"`
+
+	// Number of services of the environment registered in Consul
+	RegisteredServices int `json:"-"`
+
+	// Services on the nodes to deregister
+	nodeServices []*ServiceChange
+
+	// Nodes in Rancher the catalog is synced with, nil in local mode
+	rancherNodes map[string]*consulapi.CatalogNode
+
+	// Services gone from Rancher kept during their grace period
+	kept []*ServiceChange
+
+	// Nodes and services whose deregistration is held back
+	heldNodes []*consulapi.Node
+	held      []*ServiceChange
+}
+
+// DeregisteredServices returns the number of services the plan deregisters,
+// along with their nodes or not
+func (p *Plan) DeregisteredServices() int {
+	return len(p.DeregisterServices) + len(p.nodeServices)
+}
+
+// Empty reports whether the plan has no changes
+func (p *Plan) Empty() bool {
+	return len(p.RegisterNodes) == 0 && len(p.UpdateNodes) == 0 && len(p.DeregisterNodes) == 0 &&
+		len(p.RegisterServices) == 0 && len(p.UpdateServices) == 0 && len(p.DeregisterServices) == 0
+}
+
+// HoldDeregistrations drops the deregistrations from the plan, returning how
+// many there were. The nodes and services held back are still expected in the
+// catalog.
+func (p *Plan) HoldDeregistrations() int {
+
+	held := len(p.DeregisterNodes) + len(p.DeregisterServices)
+	p.heldNodes = append(p.heldNodes, p.DeregisterNodes...)
+	p.held = append(append(p.held, p.DeregisterServices...), p.nodeServices...)
+	p.DeregisterNodes = nil
+	p.DeregisterServices = nil
+	p.nodeServices = nil
+
+	return held
+}
+
+// RecordPlan remembers the checks and metadata of the plan as if it was
+// applied, so the next dry run only plans the changes made since this one
+func (r *Client) RecordPlan(plan *Plan) {
+
+	for _, n := range plan.DeregisterNodes {
+		r.forgetNodeChecks(n.Node)
+	}
+
+	for _, c := range plan.DeregisterServices {
+		r.setChecks(c.nodeName(), c.Service.ID, nil)
+		r.setMeta(c.nodeName(), c.Service.ID, nil)
+	}
+
+	for _, c := range append(plan.RegisterServices, plan.UpdateServices...) {
+		r.setChecks(c.nodeName(), c.Service.ID, c.Checks)
+		r.setMeta(c.nodeName(), c.Service.ID, c.Meta)
+	}
+}
+
+// nodeName returns the name of the node of the change, empty for the local agent
+func (c *ServiceChange) nodeName() string {
+
+	if c.Node == nil {
+		return ""
+	}
+
+	return c.Node.Node
+}
+
+// JSON returns the plan encoded as indented JSON
+func (p *Plan) JSON() (string, error) {
+
+	b, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+// sort orders the changes by node and service ID so plans are comparable
+func (p *Plan) sort() {
+	sort.Sort(nodesByName(p.RegisterNodes))
+	sort.Sort(nodesByName(p.UpdateNodes))
+	sort.Sort(nodesByName(p.DeregisterNodes))
+	sort.Sort(changesByID(p.RegisterServices))
+	sort.Sort(changesByID(p.UpdateServices))
+	sort.Sort(changesByID(p.DeregisterServices))
+}
+
+type nodesByName []*consulapi.Node
+
+func (n nodesByName) Len() int           { return len(n) }
+func (n nodesByName) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+func (n nodesByName) Less(i, j int) bool { return n[i].Node < n[j].Node }
+
+type changesByID []*ServiceChange
+
+func (c changesByID) Len() int      { return len(c) }
+func (c changesByID) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c changesByID) Less(i, j int) bool {
+	if c[i].Node != nil && c[j].Node != nil && c[i].Node.Node != c[j].Node.Node {
+		return c[i].Node.Node < c[j].Node.Node
+	}
+
+	return c[i].Service.ID < c[j].Service.ID
+}
@@ -0,0 +1,67 @@
+package consul
+
+import (
+	"sync"
+)
+
+// parallel runs the jobs with at most workers of them at a time, returning
+// once they are all done
+func parallel(workers int, jobs []func()) {
+
+	if workers < 1 {
+		workers = 1
+	}
+
+	queue := make(chan func())
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers && i < len(jobs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range queue {
+				job()
+			}
+		}()
+	}
+
+	for _, job := range jobs {
+		queue <- job
+	}
+	close(queue)
+
+	wg.Wait()
+}
+
+// nodeOps are operations grouped by node, in the order they were added
+type nodeOps struct {
+	nodes []string
+	ops   map[string][]func()
+}
+
+func newNodeOps() *nodeOps {
+	return &nodeOps{ops: make(map[string][]func())}
+}
+
+func (n *nodeOps) add(node string, op func()) {
+
+	if _, ok := n.ops[node]; !ok {
+		n.nodes = append(n.nodes, node)
+	}
+	n.ops[node] = append(n.ops[node], op)
+}
+
+// jobs returns a job per node making its operations one after the other
+func (n *nodeOps) jobs() (jobs []func()) {
+
+	for _, node := range n.nodes {
+		ops := n.ops[node]
+		jobs = append(jobs, func() {
+			for _, op := range ops {
+				op()
+			}
+		})
+	}
+
+	return jobs
+}
@@ -0,0 +1,143 @@
+package consul
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/waynz0r/rancher-consul-registrator/metadata"
+)
+
+// Templates customize the names, IDs and tags of the registered services and
+// nodes, a nil template keeps the default
+type Templates struct {
+	ServiceName *template.Template
+	ServiceID   *template.Template
+	NodeName    *template.Template
+	Tags        *template.Template
+}
+
+// TemplateData is what the templates are executed with
+type TemplateData struct {
+	Environment     string
+	EnvironmentUUID string
+	Stack           string
+	Service         string
+	Container       string
+	ContainerUUID   string
+	ContainerIP     string
+	Host            string
+	HostUUID        string
+	IP              string
+	Address         string
+	Port            int
+	PrivatePort     int
+	Protocol        string
+	Labels          map[string]string
+
+	// Name of the Consul service, only known to the service ID template
+	Name string
+}
+
+// ParseTemplates parses the given templates, empty ones are left unset. The
+// templates are tried against sample data so mistakes show up at startup.
+func ParseTemplates(serviceName string, serviceID string, nodeName string, tags string) (*Templates, error) {
+
+	t := &Templates{}
+
+	for _, def := range []struct {
+		name string
+		text string
+		dst  **template.Template
+	}{
+		{"service name", serviceName, &t.ServiceName},
+		{"service ID", serviceID, &t.ServiceID},
+		{"node name", nodeName, &t.NodeName},
+		{"tags", tags, &t.Tags},
+	} {
+		if def.text == "" {
+			continue
+		}
+
+		tmpl, err := template.New(def.name).Parse(def.text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s template: %v", def.name, err)
+		}
+
+		sample := TemplateData{Labels: map[string]string{}}
+		if err := tmpl.Execute(&bytes.Buffer{}, sample); err != nil {
+			return nil, fmt.Errorf("invalid %s template: %v", def.name, err)
+		}
+
+		*def.dst = tmpl
+	}
+
+	return t, nil
+}
+
+func templateData(s metadata.Service) TemplateData {
+	return TemplateData{
+		Environment:     s.EnvironmentName,
+		EnvironmentUUID: s.EnvironmentUUID,
+		Stack:           s.StackName,
+		Service:         s.Name,
+		Container:       s.ContainerName,
+		ContainerUUID:   s.ContainerUUID,
+		ContainerIP:     s.ContainerIP,
+		Host:            s.HostName,
+		HostUUID:        s.HostUUID,
+		IP:              s.IP,
+		Address:         s.ServiceAddress(),
+		Port:            s.Port,
+		PrivatePort:     s.PrivatePort,
+		Protocol:        s.Protocol,
+		Labels:          s.Labels,
+	}
+}
+
+// execute runs the template, returning defaultValue if it is unset, fails or
+// renders nothing
+func execute(tmpl *template.Template, data TemplateData, defaultValue string) string {
+
+	if tmpl == nil {
+		return defaultValue
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		logrus.Errorf("Error while executing the %s template: %v", tmpl.Name(), err)
+		return defaultValue
+	}
+
+	value := strings.TrimSpace(out.String())
+	if value == "" {
+		logrus.Warnf("The %s template rendered nothing for %s-%s, using %s", tmpl.Name(), data.Stack, data.Service, defaultValue)
+		return defaultValue
+	}
+
+	return value
+}
+
+// templateTags returns the comma separated tags rendered by the template
+func templateTags(tmpl *template.Template, data TemplateData) (tags []string) {
+
+	if tmpl == nil {
+		return tags
+	}
+
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		logrus.Errorf("Error while executing the %s template: %v", tmpl.Name(), err)
+		return tags
+	}
+
+	for _, tag := range strings.Split(out.String(), ",") {
+		if tag = strings.TrimSpace(tag); tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+
+	return tags
+}
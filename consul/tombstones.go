@@ -0,0 +1,193 @@
+package consul
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/waynz0r/rancher-consul-registrator/metadata"
+)
+
+const (
+	// Service metadata key remembering the grace period set by label, the
+	// label is gone along with the container when it is needed
+	graceMetaKey = "rancher_deregister_grace"
+)
+
+// serviceGrace returns the grace period set on the service with the
+// io.consul.service.deregister_grace label, if any
+func serviceGrace(s metadata.Service) string {
+
+	v, ok := serviceLabel(s, "deregister_grace")
+	if !ok || v == "" {
+		return ""
+	}
+
+	grace, err := time.ParseDuration(v)
+	if err != nil || grace < 0 {
+		logrus.Errorf("Invalid deregistration grace period %s for %s-%s", v, s.StackName, s.Name)
+		return ""
+	}
+
+	return grace.String()
+}
+
+// tombstone is a service gone from Rancher, along with the metadata it was
+// registered with
+type tombstone struct {
+	since time.Time
+	grace time.Duration
+	meta  map[string]string
+}
+
+// sweep is what a plan learns going through the services gone from Rancher
+type sweep struct {
+	plan *Plan
+
+	// Services tombstoned
+	seen map[string]bool
+
+	// Services Consul holds along with their metadata, read once per node
+	services map[string]map[string]*agentService
+	errors   map[string]error
+}
+
+func newSweep(plan *Plan) *sweep {
+	return &sweep{
+		plan:     plan,
+		seen:     make(map[string]bool),
+		services: make(map[string]map[string]*agentService),
+		errors:   make(map[string]error),
+	}
+}
+
+// registeredMeta returns the metadata of the service on the node, the one
+// registered last time or, after a restart or a leader handover, the one
+// Consul holds
+func (r *Client) registeredMeta(sw *sweep, node string, serviceID string) (meta map[string]string, err error) {
+
+	r.fingerprints.Lock()
+	fp, ok := r.meta[node+"/"+serviceID]
+	r.fingerprints.Unlock()
+	if ok {
+		json.Unmarshal([]byte(fp), &meta)
+		return meta, nil
+	}
+
+	if err, ok := sw.errors[node]; ok {
+		return nil, err
+	}
+
+	services, ok := sw.services[node]
+	if !ok {
+		// The vendored API knows nothing about service metadata
+		if node == "" {
+			_, err = r.Client.Raw().Query("/v1/agent/services", &services, &consulapi.QueryOptions{})
+		} else {
+			var n struct {
+				Services map[string]*agentService
+			}
+			_, err = r.Client.Raw().Query("/v1/catalog/node/"+node, &n, &consulapi.QueryOptions{})
+			services = n.Services
+		}
+		if err != nil {
+			sw.errors[node] = err
+			return nil, err
+		}
+		sw.services[node] = services
+	}
+
+	if s, ok := services[serviceID]; ok && s != nil {
+		return s.Meta, nil
+	}
+
+	return nil, nil
+}
+
+// grace returns the grace period of the service with the given metadata, the
+// one it was labeled with when registered or the default one
+func (r *Client) grace(meta map[string]string) time.Duration {
+
+	if v, ok := meta[graceMetaKey]; ok {
+		if grace, err := time.ParseDuration(v); err == nil {
+			return grace
+		}
+	}
+
+	return r.DeregisterGrace
+}
+
+// missing plans the changes for a service of the node gone from Rancher, node
+// being nil for the local agent. The service is kept during its grace period,
+// with a critical check if asked to, and deregistered after it. The services
+// tombstoned are recorded in the sweep.
+func (r *Client) missing(sw *sweep, node *consulapi.Node, service *consulapi.AgentService) (kept bool) {
+
+	plan, seen := sw.plan, sw.seen
+
+	nodeName := ""
+	if node != nil {
+		nodeName = node.Node
+	}
+	key := nodeName + "/" + service.ID
+
+	t, ok := r.tombstones[key]
+	if !ok {
+		meta, err := r.registeredMeta(sw, nodeName, service.ID)
+		if err != nil {
+			// Its grace period is unknown, keeping it until the next sync
+			logrus.Errorf("Cannot read metadata of %s, keeping it until the next sync: %v", service.ID, err)
+			seen[key] = true
+			plan.kept = append(plan.kept, &ServiceChange{Node: node, Service: service})
+			return true
+		}
+
+		t = &tombstone{since: time.Now(), grace: r.grace(meta), meta: meta}
+		if t.grace <= 0 {
+			return false
+		}
+		r.tombstones[key] = t
+		logrus.Infof("Service %s is gone from Rancher, deregistering it in %v", service.ID, t.grace)
+	}
+	seen[key] = true
+
+	if time.Since(t.since) >= t.grace {
+		return false
+	}
+
+	// Until the critical check is registered
+	checks := consulapi.AgentServiceChecks{graceCheck(t.grace)}
+	if r.CriticalDuringGrace && r.checksChanged(nodeName, service.ID, checks) {
+		plan.UpdateServices = append(plan.UpdateServices, &ServiceChange{
+			Node:    node,
+			Service: service,
+			Checks:  checks,
+			Meta:    t.meta,
+		})
+	}
+
+	plan.kept = append(plan.kept, &ServiceChange{Node: node, Service: service})
+
+	return true
+}
+
+// pruneTombstones forgets the services that are not gone anymore
+func (r *Client) pruneTombstones(sw *sweep) {
+
+	for key := range r.tombstones {
+		if !sw.seen[key] {
+			delete(r.tombstones, key)
+		}
+	}
+}
+
+// graceCheck returns the critical check of services kept during their grace period
+func graceCheck(grace time.Duration) *consulapi.AgentServiceCheck {
+
+	return &consulapi.AgentServiceCheck{
+		TTL:    grace.String(),
+		Status: "critical",
+		Notes:  "Container is gone, deregistering after the grace period",
+	}
+}
@@ -0,0 +1,270 @@
+package consul
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	// Maximum number of operations Consul accepts in a single transaction
+	maxTxnOps = 64
+)
+
+// Catalog operations of the /v1/txn endpoint, available since Consul 1.4
+type txnOp struct {
+	Node    *txnNodeOp    `json:",omitempty"`
+	Service *txnServiceOp `json:",omitempty"`
+	Check   *txnCheckOp   `json:",omitempty"`
+}
+
+type txnNodeOp struct {
+	Verb string
+	Node *consulapi.Node
+}
+
+type txnServiceOp struct {
+	Verb    string
+	Node    string
+	Service *agentService
+}
+
+type txnCheckOp struct {
+	Verb  string
+	Check *consulapi.AgentCheck
+}
+
+// txnGroup is a set of operations that must be applied in the same transaction,
+// done is called once they are
+type txnGroup struct {
+	node       string
+	desc       string
+	deregister bool
+	ops        []*txnOp
+	done       func()
+}
+
+// supportsCatalogTxn reports whether the Consul agent knows about catalog
+// operations in transactions. The result is cached after the first check.
+func (r *Client) supportsCatalogTxn() bool {
+
+	if r.catalogTxn != nil {
+		return *r.catalogTxn
+	}
+
+	self, err := r.Client.Agent().Self()
+	if err != nil {
+		logrus.Errorf("Cannot get Consul version: %v", err)
+		return false
+	}
+
+	version, _ := self["Config"]["Version"].(string)
+	supported := versionAtLeast(version, 1, 4)
+	r.catalogTxn = &supported
+
+	if !supported {
+		logrus.Infof("Consul %s doesn't support catalog transactions, falling back to single requests", version)
+	}
+
+	return supported
+}
+
+func versionAtLeast(version string, major int, minor int) bool {
+
+	parts := strings.SplitN(version, ".", 3)
+	if len(parts) < 2 {
+		return false
+	}
+
+	ma, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return false
+	}
+	mi, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return false
+	}
+
+	return ma > major || (ma == major && mi >= minor)
+}
+
+// applyCatalogPlanTxn applies the plan through transactions, packing as many
+// operations in each one as Consul allows
+func (r *Client) applyCatalogPlanTxn(plan *Plan) (registered int, deregistered int, err error) {
+
+	var groups []*txnGroup
+
+	for _, n := range plan.DeregisterNodes {
+		node := n
+		groups = append(groups, &txnGroup{
+			node:       node.Node,
+			desc:       "deregistering node " + node.Node,
+			deregister: true,
+			ops:        []*txnOp{{Node: &txnNodeOp{Verb: "delete", Node: &consulapi.Node{Node: node.Node}}}},
+			done:       func() { r.forgetNodeChecks(node.Node) },
+		})
+	}
+
+	for _, c := range plan.DeregisterServices {
+		change := c
+		groups = append(groups, &txnGroup{
+			node:       change.Node.Node,
+			desc:       "deregistering service " + change.Service.ID + " on " + change.Node.Node,
+			deregister: true,
+			ops: []*txnOp{{Service: &txnServiceOp{
+				Verb:    "delete",
+				Node:    change.Node.Node,
+				Service: &agentService{AgentService: &consulapi.AgentService{ID: change.Service.ID}},
+			}}},
+			done: func() {
+				r.setChecks(change.Node.Node, change.Service.ID, nil)
+				r.setMeta(change.Node.Node, change.Service.ID, nil)
+			},
+		})
+	}
+
+	for _, n := range append(plan.RegisterNodes, plan.UpdateNodes...) {
+		groups = append(groups, &txnGroup{
+			node: n.Node,
+			desc: "registering node " + n.Node,
+			ops:  []*txnOp{{Node: &txnNodeOp{Verb: "set", Node: n}}},
+		})
+	}
+
+	for _, c := range append(plan.RegisterServices, plan.UpdateServices...) {
+		change := c
+		group := &txnGroup{
+			node: change.Node.Node,
+			desc: "registering service " + change.Service.ID + " on " + change.Node.Node,
+			ops: []*txnOp{{Service: &txnServiceOp{
+				Verb:    "set",
+				Node:    change.Node.Node,
+				Service: &agentService{AgentService: change.Service, Meta: change.Meta},
+			}}},
+			done: func() {
+				r.setChecks(change.Node.Node, change.Service.ID, change.Checks)
+				r.setMeta(change.Node.Node, change.Service.ID, change.Meta)
+			},
+		}
+
+		for _, id := range r.staleCheckIDs(change.Node.Node, change.Service.ID, change.Checks) {
+			group.ops = append(group.ops, &txnOp{Check: &txnCheckOp{
+				Verb:  "delete",
+				Check: &consulapi.AgentCheck{Node: change.Node.Node, CheckID: id},
+			}})
+		}
+
+		for _, check := range catalogChecks(change.Node, change.Service, change.Checks) {
+			group.ops = append(group.ops, &txnOp{Check: &txnCheckOp{Verb: "set", Check: check}})
+		}
+
+		groups = append(groups, group)
+	}
+
+	// The groups of a node are kept together and in order, the groups of
+	// several nodes are packed in the same jobs while they fit in a transaction
+	byNode := make(map[string][]*txnGroup)
+	var nodes []string
+	for _, g := range groups {
+		if _, ok := byNode[g.node]; !ok {
+			nodes = append(nodes, g.node)
+		}
+		byNode[g.node] = append(byNode[g.node], g)
+	}
+
+	var jobs [][]*txnGroup
+	var job []*txnGroup
+	count := 0
+	for _, node := range nodes {
+		ops := 0
+		for _, g := range byNode[node] {
+			ops += len(g.ops)
+		}
+		if count+ops > maxTxnOps && len(job) > 0 {
+			jobs = append(jobs, job)
+			job, count = nil, 0
+		}
+		job = append(job, byNode[node]...)
+		count += ops
+	}
+	if len(job) > 0 {
+		jobs = append(jobs, job)
+	}
+
+	failed := &ApplyError{}
+
+	var mu sync.Mutex
+	var work []func()
+	for _, j := range jobs {
+		job := j
+		work = append(work, func() {
+			for _, chunk := range txnChunks(job) {
+				if err := r.commitTxn(chunk); err != nil {
+					failed.add(err, "Error while applying transaction of %d groups of operations, nothing was changed", len(chunk))
+					continue
+				}
+
+				mu.Lock()
+				for _, g := range chunk {
+					if g.deregister {
+						deregistered++
+					} else {
+						registered++
+					}
+				}
+				mu.Unlock()
+			}
+		})
+	}
+
+	parallel(r.Parallelism, work)
+
+	return registered, deregistered, failed.err()
+}
+
+// txnChunks splits the groups in chunks of at most maxTxnOps operations, a
+// group is never split
+func txnChunks(groups []*txnGroup) (chunks [][]*txnGroup) {
+
+	var chunk []*txnGroup
+	count := 0
+	for _, g := range groups {
+		if count+len(g.ops) > maxTxnOps && len(chunk) > 0 {
+			chunks = append(chunks, chunk)
+			chunk, count = nil, 0
+		}
+		chunk = append(chunk, g)
+		count += len(g.ops)
+	}
+	if len(chunk) > 0 {
+		chunks = append(chunks, chunk)
+	}
+
+	return chunks
+}
+
+// commitTxn applies the operations of the groups in a single transaction
+func (r *Client) commitTxn(groups []*txnGroup) error {
+
+	var ops []*txnOp
+	for _, g := range groups {
+		logrus.Infof("Transaction: %s", g.desc)
+		ops = append(ops, g.ops...)
+	}
+
+	_, err := r.Client.Raw().Write("/v1/txn", ops, nil, &consulapi.WriteOptions{})
+	if err != nil {
+		return err
+	}
+
+	for _, g := range groups {
+		if g.done != nil {
+			g.done()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package consul
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// fakeConsul records the catalog writes made to it
+type fakeConsul struct {
+	version string
+	fail    bool
+
+	mu        sync.Mutex
+	txns      [][]*txnOp
+	registers int
+}
+
+func (f *fakeConsul) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch req.URL.Path {
+	case "/v1/agent/self":
+		fmt.Fprintf(w, `{"Config": {"Version": %q}}`, f.version)
+	case "/v1/txn":
+		if f.fail {
+			http.Error(w, "rpc error: no leader", http.StatusInternalServerError)
+			return
+		}
+		var ops []*txnOp
+		if err := json.NewDecoder(req.Body).Decode(&ops); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f.txns = append(f.txns, ops)
+		w.Write([]byte("{}"))
+	case "/v1/catalog/register":
+		f.registers++
+		w.Write([]byte("true"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func newFakeConsul(t *testing.T, version string) (*fakeConsul, *Client) {
+
+	fake := &fakeConsul{version: version}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	client := NewClient("consul://"+strings.TrimPrefix(server.URL, "http://"), "")
+	client.Parallelism = 4
+
+	return fake, client
+}
+
+// registering returns a plan registering the nodes with the given number of
+// services each
+func registering(services ...int) *Plan {
+
+	plan := &Plan{}
+	for i, count := range services {
+		node := &consulapi.Node{Node: fmt.Sprintf("node-%d", i), Address: fmt.Sprintf("10.0.0.%d", i)}
+		plan.RegisterNodes = append(plan.RegisterNodes, node)
+		for j := 0; j < count; j++ {
+			plan.RegisterServices = append(plan.RegisterServices, &ServiceChange{
+				Node:    node,
+				Service: &consulapi.AgentService{ID: fmt.Sprintf("service-%03d", j), Service: "service", Port: 80},
+			})
+		}
+	}
+	plan.sort()
+
+	return plan
+}
+
+func TestTxnChunks(t *testing.T) {
+
+	group := func(ops int) *txnGroup {
+		return &txnGroup{ops: make([]*txnOp, ops)}
+	}
+
+	tests := []struct {
+		groups []int
+		chunks [][]int
+	}{
+		{nil, nil},
+		{[]int{1}, [][]int{{1}}},
+		{[]int{32, 32}, [][]int{{32, 32}}},
+		{[]int{32, 32, 1}, [][]int{{32, 32}, {1}}},
+		{[]int{30, 30, 30}, [][]int{{30, 30}, {30}}},
+
+		// A group is never split, even when larger than a transaction
+		{[]int{70}, [][]int{{70}}},
+		{[]int{1, 70, 1}, [][]int{{1}, {70}, {1}}},
+	}
+
+	for _, test := range tests {
+		var groups []*txnGroup
+		for _, ops := range test.groups {
+			groups = append(groups, group(ops))
+		}
+
+		var chunks [][]int
+		for _, chunk := range txnChunks(groups) {
+			var sizes []int
+			for _, g := range chunk {
+				sizes = append(sizes, len(g.ops))
+			}
+			chunks = append(chunks, sizes)
+		}
+
+		if fmt.Sprint(chunks) != fmt.Sprint(test.chunks) {
+			t.Errorf("txnChunks(%v) = %v, expected %v", test.groups, chunks, test.chunks)
+		}
+	}
+}
+
+func TestVersionAtLeast(t *testing.T) {
+
+	tests := []struct {
+		version string
+		atLeast bool
+	}{
+		{"1.4.0", true},
+		{"1.4", true},
+		{"1.10.2", true},
+		{"2.0.0", true},
+		{"1.3.9", false},
+		{"0.9.3", false},
+		{"1.4.0-rc1", true},
+		{"", false},
+		{"1", false},
+		{"dev", false},
+	}
+
+	for _, test := range tests {
+		if atLeast := versionAtLeast(test.version, 1, 4); atLeast != test.atLeast {
+			t.Errorf("versionAtLeast(%q, 1, 4) = %v, expected %v", test.version, atLeast, test.atLeast)
+		}
+	}
+}
+
+func TestApplyCatalogPlanTxn(t *testing.T) {
+
+	fake, client := newFakeConsul(t, "1.4.2")
+
+	// The services of the first node don't fit in a single transaction
+	plan := registering(80, 3, 10, 50)
+	registered, deregistered, err := client.ApplyCatalogPlan(plan)
+	if err != nil {
+		t.Fatalf("ApplyCatalogPlan failed: %v", err)
+	}
+
+	expected := 4 + 80 + 3 + 10 + 50
+	if registered != expected || deregistered != 0 {
+		t.Errorf("ApplyCatalogPlan registered %d and deregistered %d, expected %d and 0", registered, deregistered, expected)
+	}
+	if fake.registers != 0 {
+		t.Errorf("%d single registrations made, expected transactions only", fake.registers)
+	}
+
+	// The operations of every node are made in order
+	ops := make(map[string][]string)
+	total := 0
+	for _, txn := range fake.txns {
+		if len(txn) > maxTxnOps {
+			t.Errorf("Transaction of %d operations, expected at most %d", len(txn), maxTxnOps)
+		}
+		for _, op := range txn {
+			switch {
+			case op.Node != nil:
+				ops[op.Node.Node.Node] = append(ops[op.Node.Node.Node], "node")
+			case op.Service != nil:
+				ops[op.Service.Node] = append(ops[op.Service.Node], op.Service.Service.ID)
+			}
+			total++
+		}
+	}
+
+	if total != expected {
+		t.Errorf("%d operations made, expected %d", total, expected)
+	}
+	for node, count := range map[string]int{"node-0": 80, "node-1": 3, "node-2": 10, "node-3": 50} {
+		want := []string{"node"}
+		for j := 0; j < count; j++ {
+			want = append(want, fmt.Sprintf("service-%03d", j))
+		}
+		if fmt.Sprint(ops[node]) != fmt.Sprint(want) {
+			t.Errorf("Operations on %s are %v, expected %v", node, ops[node], want)
+		}
+	}
+}
+
+func TestApplyCatalogPlanWithoutTxn(t *testing.T) {
+
+	fake, client := newFakeConsul(t, "1.3.1")
+
+	plan := registering(5, 2)
+	registered, _, err := client.ApplyCatalogPlan(plan)
+	if err != nil {
+		t.Fatalf("ApplyCatalogPlan failed: %v", err)
+	}
+
+	if registered != 2+5+2 || fake.registers != 2+5+2 {
+		t.Errorf("ApplyCatalogPlan registered %d with %d single registrations, expected 9", registered, fake.registers)
+	}
+	if len(fake.txns) != 0 {
+		t.Errorf("%d transactions made to Consul 1.3, expected none", len(fake.txns))
+	}
+}
+
+func TestApplyCatalogPlanTxnFailure(t *testing.T) {
+
+	fake, client := newFakeConsul(t, "1.4.2")
+	fake.fail = true
+
+	registered, _, err := client.ApplyCatalogPlan(registering(3))
+	if _, ok := err.(*ApplyError); !ok {
+		t.Fatalf("ApplyCatalogPlan returned %v, expected an *ApplyError", err)
+	}
+	if registered != 0 {
+		t.Errorf("ApplyCatalogPlan registered %d, expected nothing", registered)
+	}
+}
@@ -0,0 +1,273 @@
+package consul
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+const (
+	watchWaitTime  = 5 * time.Minute
+	watchRetryTime = 5 * time.Second
+)
+
+// catalogView is what the blocking catalog queries tell about the nodes and
+// services of the environment: node addresses by name and services by node and
+// ID. Shared nodes are left in the catalog on purpose.
+type catalogView struct {
+	nodes    map[string]string
+	services map[string]map[string]*consulapi.AgentService
+	shared   map[string]bool
+}
+
+// setDesired records the nodes and services the catalog is about to be
+// changed to hold by the plan, along with the ones it keeps or holds back. It
+// isn't expected to hold them until the plan is applied.
+func (r *Client) setDesired(plan *Plan) {
+
+	desired := &catalogView{
+		nodes:    make(map[string]string),
+		services: make(map[string]map[string]*consulapi.AgentService),
+		shared:   make(map[string]bool),
+	}
+	for name := range r.shared {
+		desired.shared[name] = true
+	}
+
+	add := func(node *consulapi.Node, s *consulapi.AgentService) {
+		if desired.services[node.Node] == nil {
+			desired.services[node.Node] = make(map[string]*consulapi.AgentService)
+		}
+		desired.services[node.Node][s.ID] = s
+	}
+
+	// Nodes in Rancher come last, their address may be changed by the plan
+	for _, n := range plan.heldNodes {
+		desired.nodes[n.Node] = n.Address
+	}
+	for _, c := range append(plan.kept, plan.held...) {
+		desired.nodes[c.Node.Node] = c.Node.Address
+		add(c.Node, c.Service)
+	}
+	for _, n := range plan.rancherNodes {
+		desired.nodes[n.Node.Node] = n.Node.Address
+		for _, s := range n.Services {
+			add(n.Node, s)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.desired = desired
+	r.applying = true
+}
+
+func (r *Client) setApplying(applying bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.applying = applying
+}
+
+// expected returns the view the catalog should match, nil while it is being
+// changed or before the first plan
+func (r *Client) expected() *catalogView {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.applying {
+		return nil
+	}
+
+	return r.desired
+}
+
+// WatchCatalog watches the nodes of the environment in the catalog, and the
+// services of each one, with blocking queries until stop is closed, calling
+// onDrift with a description of the differences whenever they stop matching
+// the last sync plan while no sync is being applied
+func (r *Client) WatchCatalog(environmentUUID string, stop <-chan struct{}, onDrift func(drift string)) {
+
+	// Closed to stop watching the services of a node
+	nodeStops := make(map[string]chan struct{})
+	defer func() {
+		for _, nodeStop := range nodeStops {
+			close(nodeStop)
+		}
+	}()
+
+	r.watch("nodes", stop, func(q *consulapi.QueryOptions) (uint64, error) {
+		ns, meta, err := r.Client.Catalog().Nodes(q)
+		if err != nil {
+			return 0, err
+		}
+
+		nodes := make(map[string]string)
+		for _, n := range ns {
+			if isRancherNode(n, environmentUUID) {
+				nodes[n.Node] = n.Address
+			}
+		}
+
+		desired := r.expected()
+		if desired != nil {
+			if drift := nodesDrift(desired, nodes); len(drift) > 0 {
+				onDrift(strings.Join(drift, ", "))
+			}
+		}
+
+		// The services of the nodes in the catalog or expected in it are watched
+		watched := make(map[string]bool)
+		for name := range nodes {
+			watched[name] = true
+		}
+		if desired != nil {
+			for name := range desired.nodes {
+				watched[name] = true
+			}
+		}
+		for name, nodeStop := range nodeStops {
+			if !watched[name] {
+				close(nodeStop)
+				delete(nodeStops, name)
+			}
+		}
+		for name := range watched {
+			if _, ok := nodeStops[name]; !ok {
+				nodeStops[name] = make(chan struct{})
+				go r.watchNode(name, environmentUUID, nodeStops[name], onDrift)
+			}
+		}
+
+		return meta.LastIndex, nil
+	})
+}
+
+// watchNode watches the services of the environment on the node until stop is
+// closed. Missing nodes are reported by the nodes watch.
+func (r *Client) watchNode(name string, environmentUUID string, stop <-chan struct{}, onDrift func(drift string)) {
+
+	r.watch("node "+name, stop, func(q *consulapi.QueryOptions) (uint64, error) {
+		n, meta, err := r.Client.Catalog().Node(name, q)
+		if err != nil {
+			return 0, err
+		}
+		if n == nil {
+			return meta.LastIndex, nil
+		}
+
+		services := make(map[string]*consulapi.AgentService)
+		for id, s := range n.Services {
+			if isRancherRegisteredService(s, environmentUUID) {
+				services[id] = s
+			}
+		}
+
+		if desired := r.expected(); desired != nil {
+			if drift := servicesDrift(name, desired.services[name], services); len(drift) > 0 {
+				onDrift(strings.Join(drift, ", "))
+			}
+		}
+
+		return meta.LastIndex, nil
+	})
+}
+
+// watch runs the blocking query until stop is closed, each time waiting for
+// the index returned by the previous one to change
+func (r *Client) watch(what string, stop <-chan struct{}, query func(q *consulapi.QueryOptions) (uint64, error)) {
+
+	var index uint64
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		next, err := query(&consulapi.QueryOptions{WaitIndex: index, WaitTime: watchWaitTime})
+		if err != nil {
+			logrus.Errorf("Error while watching catalog %s: %v...will retry", what, err)
+			select {
+			case <-time.After(watchRetryTime):
+				continue
+			case <-stop:
+				return
+			}
+		}
+
+		// The index may go backwards, e.g. after a snapshot restore
+		if next < index {
+			next = 0
+		}
+		index = next
+	}
+}
+
+func nodesDrift(desired *catalogView, actual map[string]string) (drift []string) {
+
+	for name, address := range desired.nodes {
+		if a, ok := actual[name]; !ok {
+			drift = append(drift, "node "+name+" is missing")
+		} else if a != address {
+			drift = append(drift, fmt.Sprintf("node %s address changed to %s", name, a))
+		}
+	}
+
+	for name := range actual {
+		if _, ok := desired.nodes[name]; !ok && !desired.shared[name] {
+			drift = append(drift, "node "+name+" is not in Rancher")
+		}
+	}
+
+	sort.Strings(drift)
+
+	return drift
+}
+
+// servicesDrift compares the services of the node by ID, address, port and
+// tags
+func servicesDrift(node string, desired map[string]*consulapi.AgentService, actual map[string]*consulapi.AgentService) (drift []string) {
+
+	for id, s := range desired {
+		a, ok := actual[id]
+		if !ok {
+			drift = append(drift, fmt.Sprintf("service %s on %s is missing", id, node))
+			continue
+		}
+
+		if a.Address != s.Address || a.Port != s.Port {
+			drift = append(drift, fmt.Sprintf("service %s on %s moved to %s:%d", id, node, a.Address, a.Port))
+		}
+
+		has := make(map[string]bool)
+		for _, tag := range a.Tags {
+			has[tag] = true
+		}
+		var missing []string
+		for _, tag := range s.Tags {
+			if !has[tag] {
+				missing = append(missing, tag)
+				has[tag] = true
+			}
+		}
+		if len(missing) > 0 {
+			drift = append(drift, fmt.Sprintf("service %s on %s lost tags %v", id, node, missing))
+		}
+	}
+
+	for id := range actual {
+		if _, ok := desired[id]; !ok {
+			drift = append(drift, fmt.Sprintf("service %s on %s is not in Rancher", id, node))
+		}
+	}
+
+	sort.Strings(drift)
+
+	return drift
+}
@@ -18,25 +18,71 @@ import (
 type Context struct {
 	Rancher *metadata.Client
 	Consul  *consul.Client
+
+	// Labels and metadata keys copied into the service metadata, nil if none
+	metaKeys *regexp.Regexp
+
+	// Templates of the service names, IDs, tags and node names
+	templates *consul.Templates
+
+	mu           sync.RWMutex
+	lastSync     time.Time
+	lastErr      error
+	leader       bool
+	heartbeat    time.Time
+	nodeCount    int
+	serviceCount int
+
+	// Last error of the election, standbys failing to campaign aren't ready
+	electionErr     error
+	electionErrTime time.Time
+
+	// Deregistrations over the threshold are held back, see guard
+	threshold *Threshold
+	held      int
+	heldSyncs int
+	heldTick  int
+	confirmed bool
+
+	// Number of periodic syncs so far
+	ticks int
+
+	// Triggers a sync, set once the sync loop is started
+	trigger func(reason string)
+
+	// Closed to release the leader lock once the sync loop is done
+	stopElection chan struct{}
+	election     sync.WaitGroup
 }
 
-// InitContext initializes the application context from environmental variables
-func (c *Context) InitContext() {
+// InitContext initializes the context of the Rancher environment served by
+// the given metadata endpoint from environmental variables. The primary
+// environment is the one the registrator runs in, certs are only dumped from it.
+// An error is returned when the metadata cannot be reached.
+func (c *Context) InitContext(metadataEndpoint string, primary bool) error {
 	var err error
 
 	// Initialize Rancher metadata client
-	c.Rancher, err = metadata.NewClient(metadataURL)
+	c.Rancher, err = metadata.NewClient(metadataEndpoint, primary)
 	if err != nil {
-		logrus.Fatalf("Failed to configure rancher-metadata client: %v", err)
+		return err
 	}
-	logrus.Info("Rancher Metadata is reachable")
+	logrus.Infof("Rancher Metadata is reachable at %s (environment %s)", metadataEndpoint, c.Rancher.EnvironmentName)
+	c.Rancher.KeepUnhealthy = healthTTL > 0
+	c.Rancher.ManagedNetwork = managedNetwork
+	c.Rancher.HostService = hostService
+	c.Rancher.HostServiceName = hostServiceName
+	c.Rancher.HostServicePort = hostServicePort
+	c.Rancher.HostTagsPrefix = hostTagsPrefix
 
-	certs, err := c.Rancher.GetCerts()
-	if err != nil {
-		logrus.Fatalf("Failed to get TLS certs from metadata: %v", err)
-	}
-	if len(certs) == 3 {
-		DumpCerts(certs)
+	if primary {
+		certs, err := c.Rancher.GetCerts()
+		if err != nil {
+			logrus.Fatalf("Failed to get TLS certs from metadata: %v", err)
+		}
+		if len(certs) == 3 {
+			DumpCerts(certs)
+		}
 	}
 
 	if localMode {
@@ -55,69 +101,498 @@ func (c *Context) InitContext() {
 		}
 	} else {
 		logrus.Info("Running in remote mode!")
+		if leaderElection && !dryRun {
+			logrus.Info("Leader election enabled, syncing only while holding the lock")
+		}
+	}
+
+	if dryRun {
+		logrus.Info("Dry run, no changes will be made to Consul")
 	}
 
 	// Initialize Consul client
 	c.Consul = consul.NewClient(consulURL, consulToken)
+	c.Consul.Parallelism = parallelism
+	c.Consul.DeregisterGrace = deregisterGrace
+	c.Consul.CriticalDuringGrace = criticalDuringGrace
 	consulLeader, err := c.Consul.Ping()
 	if err != nil {
 		logrus.Fatalf("Failed to configure Consul API client: %v", err)
 	}
 	logrus.Infof("Consul API is reachable (leader is at %s)", consulLeader)
 
-	logrus.Infof("Sync interval set to %v seconds", syncInterval.Seconds())
+	if metaKeys != "" {
+		c.metaKeys, err = regexp.Compile(metaKeys)
+		if err != nil {
+			logrus.Fatalf("Bad metadata keys pattern %s: %v", metaKeys, err)
+		}
+	}
+
+	for _, source := range []string{lanAddress, wanAddress} {
+		if !contains(consul.AddressSources, source) {
+			logrus.Fatalf("Bad address source %s, expected one of %v", source, consul.AddressSources)
+		}
+	}
+
+	c.threshold, err = ParseThreshold(deregisterThreshold)
+	if err != nil {
+		logrus.Fatalf("Bad deregistration threshold: %v", err)
+	}
+
+	c.templates, err = consul.ParseTemplates(serviceNameTmpl, serviceIDTmpl, nodeNameTmpl, tagsTmpl)
+	if err != nil {
+		logrus.Fatalf("Bad template: %v", err)
+	}
+
+	if healthTTL > 0 && healthTTL <= syncInterval {
+		logrus.Warnf("Health TTL (%v) should be longer than the sync interval (%v)", healthTTL, syncInterval)
+	}
+
+	logrus.Infof("Full sync interval set to %v seconds", syncInterval.Seconds())
+	logrus.Infof("Watching metadata changes every %d seconds", changeInterval)
+
+	return nil
 }
 
-func (c *Context) Sync(local bool) {
+func (c *Context) Sync(local bool) error {
 
 	logrus.Debug("Syncing public services in Rancher...")
 
 	// Get public services from rancher
 	services, err := c.Rancher.Services(local)
 	if err != nil {
-		logrus.Fatalf("Failed to get services: %v", err)
+		return &SyncError{Phase: "rancher services", Err: err}
+	}
+
+	rancherNodes, rancherChecks, rancherMeta := consul.ConvertRancherServices(services, &consul.ConvertOptions{
+		HealthTTL:         healthTTL,
+		LoadBalancerRules: lbRules,
+		MetaKeys:          c.metaKeys,
+		Templates:         c.templates,
+		LANAddress:        lanAddress,
+		WANAddress:        wanAddress,
+	})
+
+	plan, err := c.plan(local, rancherNodes, rancherChecks, rancherMeta)
+	if plan == nil {
+		return err
+	}
+
+	// Deregistrations held back already for an incomplete view of the catalog
+	// leave the guard as it is
+	if err == nil {
+		c.guard(plan)
+	}
+
+	if dryRun {
+		if logErr := logPlan(plan); logErr != nil {
+			return logErr
+		}
+		c.Consul.RecordPlan(plan)
+		return err
 	}
 
+	// Sync
+	registered, deregistered, applyErr := c.apply(local, plan)
 	if local {
-		// Sync
-		c.Consul.SyncAgentServices(c.Rancher.EnvironmentUUID, consul.ConvertRancherServices(services))
-	} else {
-		// Get Consul nodes registered for this Rancher environment
-		nodes, err := c.Consul.Nodes(c.Rancher.EnvironmentUUID, &consulapi.QueryOptions{})
+		c.Consul.UpdateTTLChecks(rancherChecks)
+	}
+
+	registrations.Add(float64(registered), c.Rancher.EnvironmentName)
+	deregistrations.Add(float64(deregistered), c.Rancher.EnvironmentName)
+
+	serviceCount := 0
+	for _, n := range rancherNodes {
+		serviceCount += len(n.Services)
+	}
+	c.setManaged(len(rancherNodes), serviceCount)
+
+	if applyErr != nil {
+		return applyErr
+	}
+
+	// Deregistrations held back because of an incomplete view of the catalog
+	return err
+}
+
+func (c *Context) setManaged(nodes int, services int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.nodeCount = nodes
+	c.serviceCount = services
+	managedNodes.Set(float64(nodes), c.Rancher.EnvironmentName)
+	managedServices.Set(float64(services), c.Rancher.EnvironmentName)
+}
+
+// tick records that a periodic sync is due
+func (c *Context) tick() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ticks++
+}
+
+// beat records that the sync loop is alive
+func (c *Context) beat() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.heartbeat = time.Now()
+}
+
+// plan computes the changes needed to bring Consul in line with the given nodes.
+// When some nodes cannot be read, a plan without deregistrations is returned
+// along with the error.
+func (c *Context) plan(local bool, rancherNodes map[string]*consulapi.CatalogNode, rancherChecks consul.Checks, rancherMeta consul.Meta) (*consul.Plan, error) {
+
+	if local {
+		plan, err := c.Consul.PlanAgentServices(c.Rancher.EnvironmentUUID, rancherNodes, rancherChecks, rancherMeta)
 		if err != nil {
-			logrus.Fatalf("Failed to get nodes: %v", err)
+			return nil, &SyncError{Phase: "consul agent services", Err: err}
+		}
+
+		return plan, nil
+	}
+
+	// Get Consul nodes registered for this Rancher environment
+	nodes, err := c.Consul.Nodes(c.Rancher.EnvironmentUUID, &consulapi.QueryOptions{})
+	if _, incomplete := err.(*consul.NodesError); err != nil && !incomplete {
+		return nil, &SyncError{Phase: "consul nodes", Err: err}
+	}
+
+	plan := c.Consul.PlanCatalog(nodes, rancherNodes, rancherChecks, rancherMeta)
+
+	// What is missing from an incomplete view would look deregistered
+	if err != nil {
+		if held := plan.HoldDeregistrations(); held > 0 {
+			logrus.Warnf("Holding back %d deregistrations, the view of the catalog is incomplete", held)
+		}
+		return plan, &SyncError{Phase: "consul nodes", Err: err}
+	}
+
+	return plan, nil
+}
+
+// apply makes the changes of the plan, returning the number of successful
+// registrations and deregistrations. Failed changes are retried by the next sync.
+func (c *Context) apply(local bool, plan *consul.Plan) (registered int, deregistered int, err error) {
+
+	if local {
+		registered, deregistered, err = c.Consul.ApplyAgentPlan(plan)
+	} else {
+		registered, deregistered, err = c.Consul.ApplyCatalogPlan(plan)
+	}
+	if err != nil {
+		return registered, deregistered, &SyncError{Phase: "consul apply", Err: err}
+	}
+
+	return registered, deregistered, nil
+}
+
+// logPlan logs the changes a sync would make to Consul
+func logPlan(plan *consul.Plan) error {
+
+	if plan.Empty() {
+		logrus.Info("Dry run: everything is in sync")
+		return nil
+	}
+
+	out, err := plan.JSON()
+	if err != nil {
+		return &SyncError{Phase: "sync plan", Err: err}
+	}
+	logrus.Infof("Dry run: sync plan is\n%s", out)
+
+	return nil
+}
+
+// SyncWithRetry runs Sync, retrying transient failures with exponential
+// backoff until it succeeds, retries are exhausted or done is closed
+func (c *Context) SyncWithRetry(local bool, done <-chan struct{}) {
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		// Leadership may be lost between attempts
+		if c.electing() && !c.isLeader() {
+			logrus.Debug("Not the leader, skipping sync")
+			return
+		}
+
+		start := time.Now()
+		err = c.Sync(local)
+		syncDuration.Observe(time.Since(start).Seconds(), c.Rancher.EnvironmentName)
+		if err == nil {
+			break
+		}
+
+		phase := "unknown"
+		if se, ok := err.(*SyncError); ok {
+			phase = se.Phase
+		}
+		syncErrors.Inc(c.Rancher.EnvironmentName, phase)
+
+		if se, ok := err.(*SyncError); ok && !se.Transient() {
+			logrus.Errorf("Sync of %s failed with a non-transient error: %v", c.Rancher.EnvironmentName, err)
+			break
+		}
+
+		if attempt >= retryAttempts {
+			logrus.Errorf("Sync of %s failed after %d retries: %v", c.Rancher.EnvironmentName, attempt, err)
+			break
+		}
+
+		delay := backoff(attempt, retryBackoff, retryMaxDelay)
+		logrus.Warnf("Sync of %s failed: %v...will retry in %v", c.Rancher.EnvironmentName, err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-done:
+			c.setSyncResult(err)
+			return
 		}
+	}
+
+	c.setSyncResult(err)
+}
+
+func (c *Context) setSyncResult(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.lastErr = err
+	if err == nil {
+		c.lastSync = time.Now()
+		lastSuccessfulSync.Set(float64(c.lastSync.Unix()), c.Rancher.EnvironmentName)
+	}
+}
+
+// SyncResult returns the time of the last successful sync and the error of
+// the last sync attempt, if any
+func (c *Context) SyncResult() (time.Time, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.lastSync, c.lastErr
+}
+
+// electing reports whether this instance has to hold the lock of the
+// environment to sync, only remote mode instances compete for it. Dry runs
+// stay out of the election, it writes to Consul.
+func (c *Context) electing() bool {
+	return !localMode && leaderElection && !dryRun
+}
+
+func (c *Context) setElectionError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.electionErr = err
+	c.electionErrTime = time.Now()
+}
+
+// electionError returns the last error of the election if it happened within
+// the last two sync intervals, a failing election retries more often
+func (c *Context) electionError() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 
-		// Sync
-		c.Consul.SyncCatalog(nodes, consul.ConvertRancherServices(services))
+	if c.electionErr == nil || time.Since(c.electionErrTime) >= 2*syncInterval {
+		return nil
 	}
+
+	return c.electionErr
+}
+
+func (c *Context) setLeader(leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.leader = leader
+}
+
+func (c *Context) isLeader() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.leader
 }
 
-func (c *Context) Run() {
+// Contexts are the contexts of the Rancher environments synced by this instance
+type Contexts []*Context
 
-	go c.startHealthcheck()
+// Run syncs every environment until a shutdown signal is received
+func (cs Contexts) Run() {
 
 	var wg sync.WaitGroup
 	done := make(chan struct{})
 
+	for _, c := range cs {
+		c.start(done, &wg)
+	}
+
+	go cs.startHealthcheck()
+
+	signalChan := make(chan os.Signal, 1)
+	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+
+	<-signalChan
+	logrus.Infof("Shutdown signal received, exiting...")
+	close(done)
+	wg.Wait()
+
+	var stopping sync.WaitGroup
+	for _, c := range cs {
+		stopping.Add(1)
+		go func(c *Context) {
+			defer stopping.Done()
+			c.stop()
+		}(c)
+	}
+	stopping.Wait()
+}
+
+// start runs the sync loop of the environment until done is closed, along
+// with the metadata watcher and the leader election
+func (c *Context) start(done <-chan struct{}, wg *sync.WaitGroup) {
+
+	c.stopElection = make(chan struct{})
+
+	// Sync triggers are coalesced, a pending one is enough to trigger a sync
+	changes := make(chan string, 1)
+	trigger := func(reason string) {
+		select {
+		case changes <- reason:
+		default:
+		}
+	}
+	c.trigger = trigger
+
+	go c.Rancher.OnChange(changeInterval, func(version string) {
+		trigger("metadata version " + version)
+	})
+
+	// The lock is held until services are deregistered on exit
+	if c.electing() {
+		c.election.Add(1)
+		go func() {
+			defer c.election.Done()
+			c.Consul.Elect(consul.LockKey(c.Rancher.EnvironmentUUID), c.stopElection, func(leader bool) {
+				c.setLeader(leader)
+				if leader {
+					trigger("leadership acquired")
+				}
+			}, c.setElectionError)
+		}()
+	}
+
+	// Out-of-band changes are reconciled right away
+	if !localMode && watchCatalog && !dryRun {
+		go c.Consul.WatchCatalog(c.Rancher.EnvironmentUUID, done, func(drift string) {
+			if c.electing() && !c.isLeader() {
+				return
+			}
+			logrus.Warnf("Catalog of %s drifted: %s", c.Rancher.EnvironmentName, drift)
+			catalogDrifts.Inc(c.Rancher.EnvironmentName)
+			trigger("catalog drift")
+		})
+	}
+
+	wg.Add(1)
 	go func() {
-		wg.Add(1)
+		defer wg.Done()
+
+		ticker := time.NewTicker(syncInterval)
+		defer ticker.Stop()
+
+		var debounce <-chan time.Time
+
+		c.beat()
+		c.SyncWithRetry(localMode, done)
 		for {
-			c.Sync(localMode)
+			c.beat()
 			select {
-			case <-time.After(syncInterval):
+			case reason := <-changes:
+				// Waiting for the changes to settle
+				logrus.Debugf("Sync of %s triggered by %s", c.Rancher.EnvironmentName, reason)
+				debounce = time.After(syncDebounce)
+			case <-debounce:
+				debounce = nil
+				c.SyncWithRetry(localMode, done)
+			case <-ticker.C:
+				logrus.Debugf("Running periodic full sync of %s", c.Rancher.EnvironmentName)
+				c.tick()
+				c.SyncWithRetry(localMode, done)
 			case <-done:
-				wg.Done()
 				return
 			}
 		}
 	}()
+}
 
-	signalChan := make(chan os.Signal, 1)
-	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+// stop deregisters the services of the environment if asked to and releases
+// the leader lock, once the sync loop is done
+func (c *Context) stop() {
 
-	<-signalChan
-	logrus.Infof("Shutdown signal received, exiting...")
-	close(done)
-	wg.Wait()
+	if deregisterOnExit {
+		c.DeregisterWithTimeout(deregisterTimeout)
+	}
+
+	close(c.stopElection)
+	c.election.Wait()
+}
+
+// DeregisterWithTimeout runs Deregister, giving up after timeout
+func (c *Context) DeregisterWithTimeout(timeout time.Duration) {
+
+	if c.electing() && !c.isLeader() {
+		logrus.Info("Not the leader, leaving Consul as is")
+		return
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- c.Deregister(localMode)
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			logrus.Errorf("Failed to deregister services of %s on exit: %v", c.Rancher.EnvironmentName, err)
+		}
+	case <-time.After(timeout):
+		logrus.Errorf("Deregistering services of %s on exit timed out after %v", c.Rancher.EnvironmentName, timeout)
+	}
+}
+
+// Deregister removes every service of the environment from the local agent,
+// or every node of the environment from the catalog in remote mode
+func (c *Context) Deregister(local bool) error {
+
+	logrus.Infof("Deregistering services of %s...", c.Rancher.EnvironmentName)
+
+	plan, err := c.plan(local, nil, nil, nil)
+	if err != nil {
+		return err
+	}
+
+	if dryRun {
+		return logPlan(plan)
+	}
+
+	_, deregistered, err := c.apply(local, plan)
+	deregistrations.Add(float64(deregistered), c.Rancher.EnvironmentName)
+
+	return err
+}
+
+func contains(list []string, s string) bool {
+
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
 }
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/waynz0r/rancher-consul-registrator/consul"
+)
+
+// Threshold is the number of deregistrations a sync may make without
+// confirmation, either absolute or a percentage of the registered services
+type Threshold struct {
+	Count   int
+	Percent float64
+}
+
+// ParseThreshold parses "10" or "25%", an empty string disables the threshold
+func ParseThreshold(s string) (*Threshold, error) {
+
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+
+	if strings.HasSuffix(s, "%") {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("invalid percentage %s", s)
+		}
+		return &Threshold{Percent: percent}, nil
+	}
+
+	count, err := strconv.Atoi(s)
+	if err != nil || count < 0 {
+		return nil, fmt.Errorf("invalid count %s", s)
+	}
+
+	return &Threshold{Count: count}, nil
+}
+
+// Exceeded reports whether deregistering count out of registered services
+// goes over the threshold
+func (t *Threshold) Exceeded(count int, registered int) bool {
+
+	if t == nil || count == 0 {
+		return false
+	}
+
+	if t.Percent > 0 {
+		return float64(count)*100 > t.Percent*float64(registered)
+	}
+
+	return count > t.Count
+}
+
+func (t *Threshold) String() string {
+
+	if t.Percent > 0 {
+		return strconv.FormatFloat(t.Percent, 'f', -1, 64) + "%"
+	}
+
+	return strconv.Itoa(t.Count)
+}
+
+// guard holds back the deregistrations of the plan when there are more than
+// the threshold allows, until it happened for deregisterConfirmSyncs periodic
+// syncs in a row or an operator confirmed them. The syncs triggered in between,
+// e.g. by metadata changes or catalog drifts, don't count.
+func (c *Context) guard(plan *consul.Plan) {
+
+	count := plan.DeregisteredServices()
+	if !c.threshold.Exceeded(count, plan.RegisteredServices) {
+		c.setHeld(0, false)
+		return
+	}
+
+	c.mu.Lock()
+	if c.heldSyncs == 0 || c.heldTick != c.ticks {
+		c.heldSyncs++
+		c.heldTick = c.ticks
+	}
+	syncs, confirmed := c.heldSyncs, c.confirmed
+	c.mu.Unlock()
+
+	if confirmed || (deregisterConfirmSyncs > 0 && syncs >= deregisterConfirmSyncs) {
+		logrus.Warnf("Releasing %d deregistrations of %s out of %d registered services after %d syncs (confirmed: %v)",
+			count, c.Rancher.EnvironmentName, plan.RegisteredServices, syncs, confirmed)
+		c.setHeld(0, false)
+		return
+	}
+
+	plan.HoldDeregistrations()
+	logrus.Errorf("HOLDING BACK %d deregistrations of %s out of %d registered services, over the threshold of %s (%d of %d syncs), POST /admin/deregistrations/confirm on %s to release them",
+		count, c.Rancher.EnvironmentName, plan.RegisteredServices, c.threshold, syncs, deregisterConfirmSyncs, adminAddress)
+	c.setHeld(count, true)
+}
+
+// setHeld records the number of deregistrations held back, resetting the
+// count of syncs and the confirmation once they are not anymore
+func (c *Context) setHeld(count int, held bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.held = count
+	if !held {
+		c.heldSyncs = 0
+		c.confirmed = false
+	}
+	heldDeregistrations.Set(float64(count), c.Rancher.EnvironmentName)
+}
+
+// confirm releases the deregistrations held back at the next sync
+func (c *Context) confirm() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.held > 0 {
+		c.confirmed = true
+	}
+
+	return c.held
+}
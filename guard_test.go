@@ -0,0 +1,201 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/waynz0r/rancher-consul-registrator/consul"
+	"github.com/waynz0r/rancher-consul-registrator/metadata"
+)
+
+func TestParseThreshold(t *testing.T) {
+
+	tests := []struct {
+		s         string
+		threshold *Threshold
+		err       bool
+	}{
+		{"", nil, false},
+		{"  ", nil, false},
+		{"0", &Threshold{}, false},
+		{"10", &Threshold{Count: 10}, false},
+		{" 5 ", &Threshold{Count: 5}, false},
+		{"25%", &Threshold{Percent: 25}, false},
+		{"12.5%", &Threshold{Percent: 12.5}, false},
+		{"100%", &Threshold{Percent: 100}, false},
+		{"0%", &Threshold{}, false},
+		{"101%", nil, true},
+		{"-5%", nil, true},
+		{"%", nil, true},
+		{"-1", nil, true},
+		{"1.5", nil, true},
+		{"ten", nil, true},
+	}
+
+	for _, test := range tests {
+		threshold, err := ParseThreshold(test.s)
+		if test.err {
+			if err == nil {
+				t.Errorf("ParseThreshold(%q) = %v, expected an error", test.s, threshold)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseThreshold(%q) failed: %v", test.s, err)
+			continue
+		}
+		if (threshold == nil) != (test.threshold == nil) || threshold != nil && *threshold != *test.threshold {
+			t.Errorf("ParseThreshold(%q) = %v, expected %v", test.s, threshold, test.threshold)
+		}
+	}
+}
+
+func TestThresholdExceeded(t *testing.T) {
+
+	tests := []struct {
+		threshold  *Threshold
+		count      int
+		registered int
+		exceeded   bool
+	}{
+		{nil, 100, 100, false},
+		{&Threshold{Count: 10}, 0, 0, false},
+		{&Threshold{Count: 10}, 10, 100, false},
+		{&Threshold{Count: 10}, 11, 100, true},
+		{&Threshold{}, 1, 100, true},
+		{&Threshold{Percent: 25}, 25, 100, false},
+		{&Threshold{Percent: 25}, 26, 100, true},
+
+		// Nothing registered, any deregistration is too many
+		{&Threshold{Percent: 25}, 1, 0, true},
+		{&Threshold{Percent: 100}, 0, 0, false},
+
+		// No rounding of the percentage
+		{&Threshold{Percent: 33}, 1, 3, true},
+		{&Threshold{Percent: 33.4}, 1, 3, false},
+		{&Threshold{Percent: 12.5}, 1, 8, false},
+		{&Threshold{Percent: 12.5}, 2, 15, true},
+	}
+
+	for _, test := range tests {
+		if exceeded := test.threshold.Exceeded(test.count, test.registered); exceeded != test.exceeded {
+			t.Errorf("%v.Exceeded(%d, %d) = %v, expected %v", test.threshold, test.count, test.registered, exceeded, test.exceeded)
+		}
+	}
+}
+
+func TestThresholdString(t *testing.T) {
+
+	for s, threshold := range map[string]*Threshold{
+		"10":    {Count: 10},
+		"0":     {},
+		"25%":   {Percent: 25},
+		"12.5%": {Percent: 12.5},
+	} {
+		if threshold.String() != s {
+			t.Errorf("Threshold %#v is %s, expected %s", threshold, threshold, s)
+		}
+	}
+}
+
+// deregistering returns a plan deregistering count out of 10 services
+func deregistering(count int) *consul.Plan {
+	return &consul.Plan{
+		DeregisterServices: make([]*consul.ServiceChange, count),
+		RegisteredServices: 10,
+	}
+}
+
+func guardContext() *Context {
+	return &Context{
+		Rancher:   &metadata.Client{EnvironmentName: "test"},
+		threshold: &Threshold{Count: 2},
+	}
+}
+
+func TestGuardReleasesAfterPeriodicSyncs(t *testing.T) {
+
+	defer func(syncs int) { deregisterConfirmSyncs = syncs }(deregisterConfirmSyncs)
+	deregisterConfirmSyncs = 3
+
+	c := guardContext()
+
+	// Startup sync, then syncs triggered in between periodic ones
+	for i := 0; i < 5; i++ {
+		plan := deregistering(5)
+		c.guard(plan)
+		if len(plan.DeregisterServices) != 0 || c.held != 5 || c.heldSyncs != 1 {
+			t.Fatalf("Triggered sync %d: %d deregistrations left, %d held for %d syncs, expected them held for 1 sync",
+				i, len(plan.DeregisterServices), c.held, c.heldSyncs)
+		}
+	}
+
+	c.tick()
+	plan := deregistering(5)
+	c.guard(plan)
+	if len(plan.DeregisterServices) != 0 || c.heldSyncs != 2 {
+		t.Fatalf("Periodic sync 1: %d deregistrations left, held for %d syncs, expected them held for 2 syncs",
+			len(plan.DeregisterServices), c.heldSyncs)
+	}
+
+	c.tick()
+	plan = deregistering(5)
+	c.guard(plan)
+	if len(plan.DeregisterServices) != 5 || c.held != 0 || c.heldSyncs != 0 {
+		t.Fatalf("Periodic sync 2: %d deregistrations left, %d held for %d syncs, expected them released",
+			len(plan.DeregisterServices), c.held, c.heldSyncs)
+	}
+}
+
+func TestGuardNeverReleasesWithoutConfirmation(t *testing.T) {
+
+	defer func(syncs int) { deregisterConfirmSyncs = syncs }(deregisterConfirmSyncs)
+	deregisterConfirmSyncs = 0
+
+	c := guardContext()
+
+	for i := 0; i < 10; i++ {
+		c.tick()
+		plan := deregistering(5)
+		c.guard(plan)
+		if len(plan.DeregisterServices) != 0 {
+			t.Fatalf("Periodic sync %d: deregistrations released without confirmation", i)
+		}
+	}
+
+	if held := c.confirm(); held != 5 {
+		t.Fatalf("Confirmed %d deregistrations, expected 5", held)
+	}
+
+	plan := deregistering(5)
+	c.guard(plan)
+	if len(plan.DeregisterServices) != 5 || c.confirmed {
+		t.Fatalf("%d deregistrations left after confirmation (still confirmed: %v), expected them released",
+			len(plan.DeregisterServices), c.confirmed)
+	}
+}
+
+func TestGuardResetsBelowThreshold(t *testing.T) {
+
+	defer func(syncs int) { deregisterConfirmSyncs = syncs }(deregisterConfirmSyncs)
+	deregisterConfirmSyncs = 3
+
+	c := guardContext()
+
+	c.guard(deregistering(5))
+	c.tick()
+	c.guard(deregistering(5))
+
+	plan := deregistering(2)
+	c.guard(plan)
+	if len(plan.DeregisterServices) != 2 || c.held != 0 || c.heldSyncs != 0 {
+		t.Fatalf("%d deregistrations left, %d held for %d syncs, expected none held", len(plan.DeregisterServices), c.held, c.heldSyncs)
+	}
+
+	// Over the threshold again, counting starts over
+	c.tick()
+	plan = deregistering(5)
+	c.guard(plan)
+	if len(plan.DeregisterServices) != 0 || c.heldSyncs != 1 {
+		t.Fatalf("%d deregistrations left, held for %d syncs, expected them held for 1 sync", len(plan.DeregisterServices), c.heldSyncs)
+	}
+}
@@ -1,36 +1,237 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/gorilla/mux"
+	"github.com/waynz0r/rancher-consul-registrator/metrics"
 )
 
 var (
 	router = mux.NewRouter()
 )
 
-func (c *Context) startHealthcheck() {
-	router.HandleFunc("/", c.healtcheck).Methods("GET", "HEAD").Name("Healthcheck")
+// Status is the state of the registrator reported on /status. When several
+// environments are synced, the state of each one is reported in Environments.
+type Status struct {
+	Mode                string     `json:"mode,omitempty"`
+	DryRun              bool       `json:"dry_run"`
+	EnvironmentName     string     `json:"environment_name,omitempty"`
+	EnvironmentUUID     string     `json:"environment_uuid,omitempty"`
+	Leader              bool       `json:"leader"`
+	ConsulLeader        string     `json:"consul_leader,omitempty"`
+	LastSync            *time.Time `json:"last_sync,omitempty"`
+	LastError           string     `json:"last_error,omitempty"`
+	ElectionError       string     `json:"election_error,omitempty"`
+	ManagedNodes        int        `json:"managed_nodes"`
+	ManagedServices     int        `json:"managed_services"`
+	HeldDeregistrations int        `json:"held_deregistrations"`
+	HeldSyncs           int        `json:"held_syncs,omitempty"`
+	Live                bool       `json:"live"`
+	Ready               bool       `json:"ready"`
+	Environments        []*Status  `json:"environments,omitempty"`
+}
+
+func (cs Contexts) startHealthcheck() {
+	router.HandleFunc("/", cs.healtcheck).Methods("GET", "HEAD").Name("Healthcheck")
+	router.HandleFunc("/live", cs.liveness).Methods("GET", "HEAD").Name("Liveness")
+	router.HandleFunc("/ready", cs.readiness).Methods("GET", "HEAD").Name("Readiness")
+	router.HandleFunc("/status", cs.status).Methods("GET").Name("Status")
+	router.Handle("/metrics", metrics.Handler()).Methods("GET").Name("Metrics")
+
+	// Admin routes are unauthenticated, they are served apart, on loopback by default
+	if adminAddress != "" {
+		admin := mux.NewRouter()
+		admin.HandleFunc("/admin/deregistrations/confirm", cs.confirmDeregistrations).Methods("POST").Name("ConfirmDeregistrations")
+		go func() {
+			logrus.Info("Admin handler is listening on ", adminAddress)
+			logrus.Fatal(http.ListenAndServe(adminAddress, admin))
+		}()
+	}
+
 	logrus.Info("Healthcheck handler is listening on ", healtcheckPort)
 	logrus.Fatal(http.ListenAndServe(":"+strconv.Itoa(healtcheckPort), router))
 }
 
-func (c *Context) healtcheck(w http.ResponseWriter, req *http.Request) {
+func (cs Contexts) healtcheck(w http.ResponseWriter, req *http.Request) {
+
+	for _, c := range cs {
+		if err := c.healthcheck(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Write([]byte("OK"))
+}
+
+// healthcheck returns why the environment is unhealthy, if it is
+func (c *Context) healthcheck() error {
+
+	if _, err := c.SyncResult(); err != nil {
+		logrus.Errorf("Healtcheck failed: last sync of %s failed: %v", c.Rancher.EnvironmentName, err)
+		return fmt.Errorf("Last sync of %s failed: %v", c.Rancher.EnvironmentName, err)
+	}
+
+	_, err := c.Rancher.GetVersion()
+	if err != nil {
+		logrus.Errorf("Healtcheck failed: unable to reach metadata of %s", c.Rancher.EnvironmentName)
+		return fmt.Errorf("Failed to reach metadata server of %s", c.Rancher.EnvironmentName)
+	}
+
+	_, err = c.Consul.Ping()
+	if err != nil {
+		logrus.Errorf("Failed to reach Consul API: %v", err)
+		return fmt.Errorf("Failed to reach Consul API")
+	}
+
+	return nil
+}
+
+// isLive reports whether the sync loop went around recently. It wakes up at
+// least every sync interval, a sync with all its retries must fit in between.
+func (c *Context) isLive() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	timeout := 2*syncInterval + time.Duration(retryAttempts)*retryMaxDelay
+
+	return !c.heartbeat.IsZero() && time.Since(c.heartbeat) < timeout
+}
+
+// isReady reports whether a sync succeeded recently, instances standing by
+// for the leader lock are ready unless they fail to campaign for it
+func (c *Context) isReady() bool {
+
+	if c.electing() && !c.isLeader() {
+		return c.electionError() == nil
+	}
+
+	lastSync, _ := c.SyncResult()
+
+	return !lastSync.IsZero() && time.Since(lastSync) < 2*syncInterval
+}
+
+func (cs Contexts) liveness(w http.ResponseWriter, req *http.Request) {
+
+	for _, c := range cs {
+		if !c.isLive() {
+			http.Error(w, "Sync loop of "+c.Rancher.EnvironmentName+" is not responding", http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Write([]byte("OK"))
+}
+
+func (cs Contexts) readiness(w http.ResponseWriter, req *http.Request) {
+
+	for _, c := range cs {
+		if !c.isReady() {
+			if err := c.electionError(); err != nil {
+				http.Error(w, "Leader election of "+c.Rancher.EnvironmentName+" failed: "+err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+			http.Error(w, "No recent successful sync of "+c.Rancher.EnvironmentName, http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	w.Write([]byte("OK"))
+}
 
-	_, err := c.Rancher.Client.GetSelfStack()
+func (cs Contexts) status(w http.ResponseWriter, req *http.Request) {
+
+	consulLeader, err := cs[0].Consul.Ping()
 	if err != nil {
-		logrus.Error("Healtcheck failed: unable to reach metadata")
-		http.Error(w, "Failed to reach metadata server", http.StatusInternalServerError)
+		logrus.Errorf("Failed to reach Consul API: %v", err)
+	}
+
+	var status *Status
+	if len(cs) == 1 {
+		status = cs[0].status()
 	} else {
-		_, err := c.Consul.Ping()
-		if err != nil {
-			logrus.Errorf("Failed to reach Consul API: %v", err)
-			http.Error(w, "Failed to reach Consul API ", http.StatusInternalServerError)
-		} else {
-			w.Write([]byte("OK"))
+		// Every environment has to be live and ready
+		status = &Status{Live: true, Ready: true}
+		for _, c := range cs {
+			s := c.status()
+			s.Mode, s.ConsulLeader = "", ""
+			status.Leader = status.Leader || s.Leader
+			status.Live = status.Live && s.Live
+			status.Ready = status.Ready && s.Ready
+			status.ManagedNodes += s.ManagedNodes
+			status.ManagedServices += s.ManagedServices
+			status.HeldDeregistrations += s.HeldDeregistrations
+			status.Environments = append(status.Environments, s)
+		}
+	}
+
+	status.Mode = "local"
+	if !localMode {
+		status.Mode = "remote"
+	}
+	status.DryRun = dryRun
+	status.ConsulLeader = consulLeader
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// status returns the state of the environment
+func (c *Context) status() *Status {
+
+	status := &Status{
+		EnvironmentName: c.Rancher.EnvironmentName,
+		EnvironmentUUID: c.Rancher.EnvironmentUUID,
+		Leader:          !c.electing() || c.isLeader(),
+		Live:            c.isLive(),
+		Ready:           c.isReady(),
+	}
+	if err := c.electionError(); err != nil {
+		status.ElectionError = err.Error()
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if !c.lastSync.IsZero() {
+		lastSync := c.lastSync
+		status.LastSync = &lastSync
+	}
+	if c.lastErr != nil {
+		status.LastError = c.lastErr.Error()
+	}
+	status.ManagedNodes = c.nodeCount
+	status.ManagedServices = c.serviceCount
+	status.HeldDeregistrations = c.held
+	status.HeldSyncs = c.heldSyncs
+
+	return status
+}
+
+// confirmDeregistrations releases the deregistrations held back at the next
+// sync, of every environment or of the one named by the environment parameter
+func (cs Contexts) confirmDeregistrations(w http.ResponseWriter, req *http.Request) {
+
+	environment := req.URL.Query().Get("environment")
+
+	confirmed := 0
+	for _, c := range cs {
+		if environment != "" && environment != c.Rancher.EnvironmentName && environment != c.Rancher.EnvironmentUUID {
+			continue
+		}
+
+		if held := c.confirm(); held > 0 {
+			logrus.Warnf("Deregistrations of %s confirmed by %s", c.Rancher.EnvironmentName, req.RemoteAddr)
+			confirmed += held
+			c.trigger("deregistrations confirmed")
 		}
 	}
+
+	w.Write([]byte("Confirmed " + strconv.Itoa(confirmed) + " deregistrations\n"))
 }
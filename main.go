@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"strings"
 	"time"
 
 	"github.com/Sirupsen/logrus"
@@ -9,23 +10,83 @@ import (
 )
 
 var (
-	metadataURL    string
-	consulURL      string
-	consulToken    string
-	certDir        string
-	syncInterval   time.Duration
-	healtcheckPort int
-	localMode      bool
+	metadataURL            string
+	consulURL              string
+	consulToken            string
+	certDir                string
+	syncInterval           time.Duration
+	changeInterval         int
+	syncDebounce           time.Duration
+	retryAttempts          int
+	retryBackoff           time.Duration
+	retryMaxDelay          time.Duration
+	healthTTL              time.Duration
+	healtcheckPort         int
+	adminAddress           string
+	localMode              bool
+	managedNetwork         bool
+	lbRules                bool
+	parallelism            int
+	watchCatalog           bool
+	lanAddress             string
+	wanAddress             string
+	hostService            bool
+	hostServiceName        string
+	hostServicePort        int
+	hostTagsPrefix         string
+	metaKeys               string
+	serviceNameTmpl        string
+	serviceIDTmpl          string
+	nodeNameTmpl           string
+	tagsTmpl               string
+	dryRun                 bool
+	leaderElection         bool
+	deregisterOnExit       bool
+	deregisterThreshold    string
+	deregisterConfirmSyncs int
+	deregisterGrace        time.Duration
+	criticalDuringGrace    bool
+	deregisterTimeout      time.Duration
 )
 
 func init() {
-	flag.StringVar(&metadataURL, "metadata-url", "http://rancher-metadata.rancher.internal/latest", "Rancher metadata URL")
+	flag.StringVar(&metadataURL, "metadata-url", "http://rancher-metadata.rancher.internal/latest", "Rancher metadata URL, a comma separated list to sync several environments in remote mode")
 	flag.StringVar(&consulURL, "consul-url", "consul://RancherHostIP:8500", "Consul API URL")
 	flag.StringVar(&consulToken, "consul-token", "", "Consul client token")
 	flag.StringVar(&certDir, "cert-dir", "/", "Where to dump the cert files from Rancher metadata")
-	flag.DurationVar(&syncInterval, "sync-interval", (10 * time.Second), "Time duration between service syncs")
+	flag.DurationVar(&syncInterval, "sync-interval", (60 * time.Second), "Time duration between periodic full service syncs")
+	flag.IntVar(&changeInterval, "change-interval", 1, "Seconds between Rancher metadata version checks")
+	flag.DurationVar(&syncDebounce, "sync-debounce", (2 * time.Second), "Time to wait for further metadata changes before syncing")
+	flag.IntVar(&retryAttempts, "retry-attempts", 5, "Number of retries of a failed sync before giving up until the next one")
+	flag.DurationVar(&retryBackoff, "retry-backoff", (1 * time.Second), "Initial delay between retries of a failed sync")
+	flag.DurationVar(&retryMaxDelay, "retry-max-delay", (30 * time.Second), "Maximum delay between retries of a failed sync")
+	flag.DurationVar(&healthTTL, "health-ttl", (3 * time.Minute), "TTL of the checks mirroring container health states, 0 to drop unhealthy containers instead")
 	flag.IntVar(&healtcheckPort, "healthcheck-port", 10000, "HTTP healthcheck port")
+	flag.StringVar(&adminAddress, "admin-address", "127.0.0.1:10001", "Address of the unauthenticated HTTP admin endpoints, empty to disable them")
 	flag.BoolVar(&localMode, "local-mode", true, "Only sync to local agent or register everything to remote Consul API")
+	flag.BoolVar(&managedNetwork, "managed-network", false, "Register containers with their managed network IP and container ports instead of the published host ports")
+	flag.BoolVar(&hostService, "host-service", true, "Register a service for every Rancher host running registered containers")
+	flag.StringVar(&hostServiceName, "host-service-name", "", "Name of the host services (defaults to rancher-host)")
+	flag.IntVar(&hostServicePort, "host-service-port", 0, "Port of the host services, e.g. the Rancher agent port")
+	flag.StringVar(&hostTagsPrefix, "host-tags-prefix", "", "Add the host labels with this prefix to the host services as <label without prefix>=<value> tags, e.g. io.rancher.host.")
+	flag.StringVar(&lanAddress, "lan-address", "agent", "Source of the lan tagged address of the nodes in remote mode: agent, external or none")
+	flag.StringVar(&wanAddress, "wan-address", "external", "Source of the wan tagged address of the nodes in remote mode: agent, external or none")
+	flag.BoolVar(&lbRules, "lb-rules", true, "Register the port rules of Rancher load balancers as <stack>-<service>-lb services")
+	flag.StringVar(&metaKeys, "meta-keys", "", "Regular expression of the labels and Rancher service metadata keys to copy into the Consul service metadata, e.g. ^com\\.example\\.")
+	flag.StringVar(&serviceNameTmpl, "service-name-template", "", "Go template of the service names, e.g. {{.Stack}}.{{.Service}} (defaults to <stack>-<service>)")
+	flag.StringVar(&serviceIDTmpl, "service-id-template", "", "Go template of the service IDs, {{.Name}} is the service name (defaults to <name>-<container uuid>-<port>)")
+	flag.StringVar(&nodeNameTmpl, "node-name-template", "", "Go template of the node names (defaults to the Rancher host name)")
+	flag.StringVar(&tagsTmpl, "tags-template", "", "Go template of a comma separated list of additional service tags")
+	flag.BoolVar(&watchCatalog, "watch-catalog", true, "In remote mode, watch the catalog and sync as soon as the nodes and services of the environment are changed by others")
+	flag.IntVar(&parallelism, "parallelism", 4, "In remote mode, number of Consul nodes read or synced at the same time")
+	flag.BoolVar(&leaderElection, "leader-election", true, "In remote mode, only sync while holding a Consul lock shared by the registrators of the environment")
+	flag.StringVar(&deregisterThreshold, "deregister-threshold", "", "Hold back the deregistrations of a sync above this number, or percentage of the registered services with a % suffix, e.g. 25%")
+	flag.IntVar(&deregisterConfirmSyncs, "deregister-confirm-syncs", 3, "Release the deregistrations held back once they were for this many syncs in a row, 0 to wait for an operator to confirm them")
+	flag.DurationVar(&deregisterGrace, "deregister-grace", 0, "Keep the services of containers gone from Rancher registered for this long, e.g. to ride out a container restart")
+	flag.BoolVar(&criticalDuringGrace, "critical-during-grace", false, "Mark the services kept during their deregistration grace period critical")
+	flag.BoolVar(&deregisterOnExit, "deregister-on-exit", false, "Deregister the services of the environment on shutdown")
+	flag.DurationVar(&deregisterTimeout, "deregister-timeout", (10 * time.Second), "Maximum time to spend deregistering services on shutdown")
+	flag.BoolVar(&dryRun, "dry-run", false, "Log the changes a sync would make to Consul as JSON without making them")
 	logrus.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
 	logrus.SetOutput(os.Stdout)
 }
@@ -36,9 +97,38 @@ func main() {
 
 	logrus.Info("Starting Consul Service Registrator")
 
-	context := &Context{}
-	context.InitContext()
-	context.Run()
+	endpoints := metadataEndpoints(metadataURL)
+	if len(endpoints) > 1 && localMode {
+		logrus.Fatal("Several Rancher environments can only be synced in remote mode")
+	}
+
+	// Other environments are left out when their metadata is unreachable
+	var contexts Contexts
+	for i, endpoint := range endpoints {
+		context := &Context{}
+		if err := context.InitContext(endpoint, i == 0); err != nil {
+			if i == 0 {
+				logrus.Fatalf("Failed to configure rancher-metadata client: %v", err)
+			}
+			logrus.Errorf("Failed to configure rancher-metadata client of %s, leaving it out: %v", endpoint, err)
+			continue
+		}
+		contexts = append(contexts, context)
+	}
+
+	contexts.Run()
 
 	os.Exit(0)
 }
+
+// metadataEndpoints splits the comma separated list of metadata URLs
+func metadataEndpoints(list string) (endpoints []string) {
+
+	for _, endpoint := range strings.Split(list, ",") {
+		if endpoint = strings.TrimSpace(endpoint); endpoint != "" {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	return endpoints
+}
@@ -2,6 +2,7 @@ package metadata
 
 import (
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -10,10 +11,48 @@ import (
 	"github.com/rancher/go-rancher-metadata/metadata"
 )
 
+const (
+	// NetworkLabel selects how the containers of a service are registered:
+	// "host" (published ports on the host IP) or "managed" (container IP)
+	NetworkLabel = "io.consul.service.network"
+
+	// NameLabel and TagsLabel set the name and additional tags of the Consul service
+	NameLabel = "io.consul.service.name"
+	TagsLabel = "io.consul.service.tags"
+
+	// ExternalIPLabel is the host label holding the IP the host is reachable at
+	// from outside, it takes precedence over the agent IP
+	ExternalIPLabel = "io.rancher.host.external_dns_ip"
+
+	// LoadBalancerKind is the kind of Rancher load balancer services
+	LoadBalancerKind = "loadBalancerService"
+
+	// PortsLabel lists the container ports to register on the managed network
+	// besides the published ones, e.g. "8080,9090"
+	PortsLabel = "io.consul.service.ports"
+)
+
 type Client struct {
 	Client          metadata.Client
 	EnvironmentName string
 	EnvironmentUUID string
+
+	// Keep running containers regardless of their health state
+	KeepUnhealthy bool
+
+	// Register containers with their managed network IP unless labeled otherwise
+	ManagedNetwork bool
+
+	// Register a service for every host running registered containers
+	HostService bool
+
+	// Name and port of the host services, defaults to rancher-host without port
+	HostServiceName string
+	HostServicePort int
+
+	// Host labels with this prefix are added to the host services as
+	// <label without prefix>=<value> tags, empty for none
+	HostTagsPrefix string
 }
 
 type Service struct {
@@ -22,34 +61,65 @@ type Service struct {
 	EnvironmentName string
 	EnvironmentUUID string
 	HostName        string
+	HostUUID        string
+	Host            *metadata.Host
 	IP              string
+	Address         string
 	Port            int
+	PrivatePort     int
+	Protocol        string
+	ContainerIP     string
+	ContainerName   string
+	ContainerUUID   string
+	HealthState     string
+	HealthCheck     *metadata.HealthCheck
+	Labels          map[string]string
+	Metadata        map[string]interface{}
+	Kind            string
+	PortRules       []metadata.PortRule
+}
+
+// ServiceAddress returns the address the service is reachable at
+func (s Service) ServiceAddress() string {
+
+	if s.Address != "" {
+		return s.Address
+	}
+
+	return s.IP
 }
 
-func NewClient(metadataURL string) (*Client, error) {
+// NewClient returns a client of the metadata served at metadataURL. Only the
+// metadata of the environment the registrator runs in knows about it, self,
+// the environment of the others is found through their stacks.
+func NewClient(metadataURL string, self bool) (*Client, error) {
 	m, err := metadata.NewClientAndWait(metadataURL)
 	if err != nil {
-		logrus.Fatalf("Failed to configure rancher-metadata: %v", err)
+		return nil, err
 	}
 
-	envName, envUUID, err := getEnvironment(m)
+	envName, envUUID, err := getEnvironment(m, self)
 	if err != nil {
-		logrus.Fatalf("Error reading stack info: %v", err)
+		return nil, err
 	}
 
 	return &Client{
-		Client:          m,
+		Client:          &instrumentedClient{m},
 		EnvironmentName: envName,
 		EnvironmentUUID: envUUID,
 	}, nil
 }
 
-func getEnvironment(m metadata.Client) (string, string, error) {
+func getEnvironment(m metadata.Client, self bool) (string, string, error) {
 	timeout := 30 * time.Second
 	var err error
 	var stack metadata.Stack
 	for i := 1 * time.Second; i < timeout; i *= time.Duration(2) {
-		stack, err = m.GetSelfStack()
+		if self {
+			stack, err = m.GetSelfStack()
+		} else {
+			stack, err = anyStack(m)
+		}
 		if err != nil {
 			logrus.Errorf("Error reading stack info: %v...will retry", err)
 			time.Sleep(i)
@@ -60,6 +130,23 @@ func getEnvironment(m metadata.Client) (string, string, error) {
 	return "", "", fmt.Errorf("Error reading stack info: %v", err)
 }
 
+// anyStack returns a stack of the environment, every stack knows about it
+func anyStack(m metadata.Client) (metadata.Stack, error) {
+
+	stacks, err := m.GetStacks()
+	if err != nil {
+		return metadata.Stack{}, err
+	}
+
+	for _, stack := range stacks {
+		if stack.EnvironmentUUID != "" {
+			return stack, nil
+		}
+	}
+
+	return metadata.Stack{}, fmt.Errorf("no stack")
+}
+
 func (m *Client) GetCerts() (certs map[string]string, err error) {
 
 	s, err := m.Client.GetSelfService()
@@ -83,6 +170,21 @@ func (m *Client) GetVersion() (string, error) {
 	return m.Client.GetVersion()
 }
 
+// OnChange calls do with the new metadata version whenever it changes,
+// checking every intervalSeconds. The version found first is left out, the
+// startup sync is done with it. It never returns.
+func (m *Client) OnChange(intervalSeconds int, do func(string)) {
+
+	first := true
+	m.Client.OnChange(intervalSeconds, func(version string) {
+		if first {
+			first = false
+			return
+		}
+		do(version)
+	})
+}
+
 func (m *Client) Services(self bool) (services []Service, err error) {
 
 	containers, err := m.Client.GetContainers()
@@ -90,8 +192,41 @@ func (m *Client) Services(self bool) (services []Service, err error) {
 		return services, err
 	}
 
+	rancherServices, err := m.rancherServices()
+	if err != nil {
+		return services, err
+	}
+
+	hosts := make(map[string]bool)
+
 	for _, container := range containers {
-		if len(container.ServiceName) == 0 || len(container.Ports) == 0 || !containerStateOK(container) {
+		if len(container.ServiceName) == 0 || !containerStateOK(container, m.KeepUnhealthy) {
+			continue
+		}
+
+		rancherService := rancherServices[container.StackName+"/"+container.ServiceName]
+
+		// Container labels take precedence over the ones set on the service
+		labels := make(map[string]string)
+		for k, v := range rancherService.Labels {
+			labels[k] = v
+		}
+		for k, v := range container.Labels {
+			labels[k] = v
+		}
+
+		managed := m.managedNetwork(labels)
+
+		var exposedPorts []int
+		if managed {
+			if len(container.PrimaryIp) == 0 {
+				logrus.Debugf("Container's %v primary_ip is empty", container.Name)
+				continue
+			}
+			exposedPorts = parsePortList(labels[PortsLabel])
+		}
+
+		if len(container.Ports) == 0 && len(exposedPorts) == 0 {
 			continue
 		}
 
@@ -114,51 +249,182 @@ func (m *Client) Services(self bool) (services []Service, err error) {
 			continue
 		}
 
-		ip, ok := host.Labels["io.rancher.host.external_dns_ip"]
+		ip, ok := host.Labels[ExternalIPLabel]
 
 		if !ok || ip == "" {
 			ip = host.AgentIP
 		}
 
-		// Register the host itself as a service
-		services = append(services, Service{
-			Name:            "host",
-			StackName:       "rancher",
-			EnvironmentName: m.EnvironmentName,
-			EnvironmentUUID: m.EnvironmentUUID,
-			HostName:        host.Name,
-			IP:              ip,
-		})
+		// Register the host itself as a service, once
+		if m.HostService && !hosts[host.UUID] {
+			services = append(services, m.hostService(host, ip))
+			hosts[host.UUID] = true
+		}
 
-		for _, portDef := range container.Ports {
-			port, err := strconv.Atoi(strings.Split(portDef, ":")[1])
-			if err != nil {
-				logrus.Errorf("%v", err)
-				continue
-			}
+		var healthCheck *metadata.HealthCheck
+		if rancherService.HealthCheck.Port != 0 {
+			healthCheck = &rancherService.HealthCheck
+		}
 
-			services = append(services, Service{
+		service := func(spec PortSpec) Service {
+			s := Service{
 				Name:            container.ServiceName,
 				StackName:       container.StackName,
 				EnvironmentName: m.EnvironmentName,
 				EnvironmentUUID: m.EnvironmentUUID,
 				HostName:        host.Name,
-				Port:            port,
+				HostUUID:        host.UUID,
+				Host:            &host,
+				Port:            spec.HostPort,
+				PrivatePort:     spec.ContainerPort,
+				Protocol:        spec.Protocol,
 				IP:              ip,
-			})
+				ContainerIP:     container.PrimaryIp,
+				ContainerName:   container.Name,
+				ContainerUUID:   container.UUID,
+				HealthState:     container.HealthState,
+				HealthCheck:     healthCheck,
+				Labels:          labels,
+				Metadata:        rancherService.Metadata,
+				Kind:            rancherService.Kind,
+			}
+
+			if rancherService.Kind == LoadBalancerKind {
+				s.PortRules = rancherService.LBConfig.PortRules
+			}
+
+			// On the managed network the container is reached directly,
+			// otherwise through the host IP the port is bound to, if any
+			if managed {
+				s.Address = container.PrimaryIp
+				s.Port = spec.ContainerPort
+			} else if !unspecifiedIP(spec.BindIP) {
+				s.Address = spec.BindIP
+			}
+
+			return s
+		}
+
+		registered := make(map[string]bool)
+		for _, portDef := range container.Ports {
+			specs, err := ParsePortSpec(portDef)
+			if err != nil {
+				logrus.Errorf("Container %v: %v", container.Name, err)
+				continue
+			}
+
+			for _, spec := range specs {
+				if !spec.Published() && !managed {
+					continue
+				}
+
+				services = append(services, service(spec))
+				registered[strconv.Itoa(spec.ContainerPort)+"/"+spec.Protocol] = true
+			}
+		}
+
+		for _, port := range exposedPorts {
+			if !registered[strconv.Itoa(port)+"/tcp"] {
+				services = append(services, service(PortSpec{ContainerPort: port, Protocol: "tcp"}))
+			}
 		}
 	}
 
 	return services, nil
 }
 
-func containerStateOK(container metadata.Container) bool {
+// hostService returns the service registered for the host
+func (m *Client) hostService(host metadata.Host, ip string) Service {
+
+	labels := make(map[string]string)
+	if m.HostServiceName != "" {
+		labels[NameLabel] = m.HostServiceName
+	}
+
+	if m.HostTagsPrefix != "" {
+		var tags []string
+		for k, v := range host.Labels {
+			if strings.HasPrefix(k, m.HostTagsPrefix) {
+				tags = append(tags, strings.TrimPrefix(k, m.HostTagsPrefix)+"="+v)
+			}
+		}
+		sort.Strings(tags)
+		labels[TagsLabel] = strings.Join(tags, ",")
+	}
+
+	return Service{
+		Name:            "host",
+		StackName:       "rancher",
+		EnvironmentName: m.EnvironmentName,
+		EnvironmentUUID: m.EnvironmentUUID,
+		HostName:        host.Name,
+		HostUUID:        host.UUID,
+		Host:            &host,
+		IP:              ip,
+		Port:            m.HostServicePort,
+		Labels:          labels,
+	}
+}
+
+// managedNetwork reports whether containers with the given labels are
+// registered with their managed network IP
+func (m *Client) managedNetwork(labels map[string]string) bool {
+
+	switch labels[NetworkLabel] {
+	case "managed":
+		return true
+	case "host":
+		return false
+	}
+
+	return m.ManagedNetwork
+}
+
+func parsePortList(list string) (ports []int) {
+
+	for _, p := range strings.Split(list, ",") {
+		if p = strings.TrimSpace(p); p == "" {
+			continue
+		}
+
+		port, err := strconv.Atoi(p)
+		if err != nil {
+			logrus.Errorf("Invalid port in %s label: %v", PortsLabel, err)
+			continue
+		}
+		ports = append(ports, port)
+	}
+
+	return ports
+}
+
+// rancherServices returns every Rancher service keyed by stack and service name
+func (m *Client) rancherServices() (map[string]metadata.Service, error) {
+
+	services, err := m.Client.GetServices()
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]metadata.Service)
+	for _, service := range services {
+		result[service.StackName+"/"+service.Name] = service
+	}
+
+	return result, nil
+}
+
+func containerStateOK(container metadata.Container, keepUnhealthy bool) bool {
 	switch container.State {
 	case "running":
 	default:
 		return false
 	}
 
+	if keepUnhealthy {
+		return true
+	}
+
 	switch container.HealthState {
 	case "healthy":
 	case "initializing":
@@ -0,0 +1,61 @@
+package metadata
+
+import (
+	"time"
+
+	"github.com/rancher/go-rancher-metadata/metadata"
+	"github.com/waynz0r/rancher-consul-registrator/metrics"
+)
+
+var (
+	requestDuration = metrics.NewHistogram(
+		"rancher_consul_registrator_metadata_request_duration_seconds",
+		"Latency of the requests to Rancher metadata",
+		metrics.DefaultBuckets,
+		"call",
+	)
+)
+
+// instrumentedClient measures the latency of the metadata calls made by the registrator
+type instrumentedClient struct {
+	metadata.Client
+}
+
+func observe(call string, start time.Time) {
+	requestDuration.Observe(time.Since(start).Seconds(), call)
+}
+
+func (c *instrumentedClient) GetVersion() (string, error) {
+	defer observe("version", time.Now())
+	return c.Client.GetVersion()
+}
+
+func (c *instrumentedClient) GetSelfHost() (metadata.Host, error) {
+	defer observe("self_host", time.Now())
+	return c.Client.GetSelfHost()
+}
+
+func (c *instrumentedClient) GetSelfService() (metadata.Service, error) {
+	defer observe("self_service", time.Now())
+	return c.Client.GetSelfService()
+}
+
+func (c *instrumentedClient) GetSelfStack() (metadata.Stack, error) {
+	defer observe("self_stack", time.Now())
+	return c.Client.GetSelfStack()
+}
+
+func (c *instrumentedClient) GetServices() ([]metadata.Service, error) {
+	defer observe("services", time.Now())
+	return c.Client.GetServices()
+}
+
+func (c *instrumentedClient) GetContainers() ([]metadata.Container, error) {
+	defer observe("containers", time.Now())
+	return c.Client.GetContainers()
+}
+
+func (c *instrumentedClient) GetHost(UUID string) (metadata.Host, error) {
+	defer observe("host", time.Now())
+	return c.Client.GetHost(UUID)
+}
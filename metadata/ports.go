@@ -0,0 +1,142 @@
+package metadata
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Maximum number of ports of a range, each one is registered as a service
+	maxPortRange = 100
+)
+
+// PortSpec is a single port of a Rancher port definition
+type PortSpec struct {
+	BindIP        string
+	HostPort      int
+	ContainerPort int
+	Protocol      string
+}
+
+// Published reports whether the port is published on the host
+func (p PortSpec) Published() bool {
+	return p.HostPort != 0
+}
+
+// ParsePortSpec parses a port definition like "[bindIP:][hostPort:]containerPort[/protocol]",
+// where ports can be ranges (e.g. "8000-8010"), into one PortSpec per port
+func ParsePortSpec(def string) ([]PortSpec, error) {
+
+	orig := def
+	protocol := "tcp"
+	if i := strings.LastIndex(def, "/"); i >= 0 {
+		protocol = strings.ToLower(def[i+1:])
+		def = def[:i]
+		if protocol == "" {
+			return nil, fmt.Errorf("invalid port definition %q: empty protocol", orig)
+		}
+	}
+
+	var bindIP, hostPart, containerPart string
+
+	// IPv6 bind addresses are enclosed in brackets
+	if strings.HasPrefix(def, "[") {
+		end := strings.Index(def, "]:")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid port definition %q: unterminated IPv6 address", orig)
+		}
+		bindIP = def[1:end]
+		def = def[end+2:]
+	}
+
+	parts := strings.Split(def, ":")
+	switch {
+	case len(parts) == 1 && bindIP == "":
+		containerPart = parts[0]
+	case len(parts) == 2:
+		hostPart, containerPart = parts[0], parts[1]
+	case len(parts) == 3 && bindIP == "":
+		bindIP, hostPart, containerPart = parts[0], parts[1], parts[2]
+	default:
+		return nil, fmt.Errorf("invalid port definition %q", orig)
+	}
+
+	if bindIP != "" && net.ParseIP(bindIP) == nil {
+		return nil, fmt.Errorf("invalid port definition %q: bad bind IP %q", orig, bindIP)
+	}
+
+	containerStart, containerEnd, err := parsePortRange(containerPart)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port definition %q: %v", orig, err)
+	}
+
+	hostStart, hostEnd := 0, 0
+	if hostPart != "" {
+		hostStart, hostEnd, err = parsePortRange(hostPart)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port definition %q: %v", orig, err)
+		}
+		if hostEnd-hostStart != containerEnd-containerStart {
+			return nil, fmt.Errorf("invalid port definition %q: host and container port ranges differ in size", orig)
+		}
+	}
+
+	specs := make([]PortSpec, 0, containerEnd-containerStart+1)
+	for i := 0; i <= containerEnd-containerStart; i++ {
+		spec := PortSpec{
+			BindIP:        bindIP,
+			ContainerPort: containerStart + i,
+			Protocol:      protocol,
+		}
+		if hostPart != "" {
+			spec.HostPort = hostStart + i
+		}
+		specs = append(specs, spec)
+	}
+
+	return specs, nil
+}
+
+func parsePortRange(r string) (start int, end int, err error) {
+
+	bounds := strings.SplitN(r, "-", 2)
+
+	start, err = parsePort(bounds[0])
+	if err != nil {
+		return 0, 0, err
+	}
+
+	end = start
+	if len(bounds) == 2 {
+		end, err = parsePort(bounds[1])
+		if err != nil {
+			return 0, 0, err
+		}
+		if end < start {
+			return 0, 0, fmt.Errorf("bad port range %q", r)
+		}
+		if end-start+1 > maxPortRange {
+			return 0, 0, fmt.Errorf("port range %q has more than %d ports", r, maxPortRange)
+		}
+	}
+
+	return start, end, nil
+}
+
+func parsePort(p string) (int, error) {
+
+	port, err := strconv.Atoi(p)
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("bad port %q", p)
+	}
+
+	return port, nil
+}
+
+// unspecifiedIP reports whether ip binds every interface of the host
+func unspecifiedIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed == nil || parsed.IsUnspecified()
+}
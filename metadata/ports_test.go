@@ -0,0 +1,71 @@
+package metadata
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParsePortSpec(t *testing.T) {
+
+	tests := []struct {
+		def   string
+		specs []PortSpec
+	}{
+		{"8080", []PortSpec{{ContainerPort: 8080, Protocol: "tcp"}}},
+		{":8080", []PortSpec{{ContainerPort: 8080, Protocol: "tcp"}}},
+		{"80:8080/udp", []PortSpec{{HostPort: 80, ContainerPort: 8080, Protocol: "udp"}}},
+		{"0.0.0.0:80:8080/tcp", []PortSpec{{BindIP: "0.0.0.0", HostPort: 80, ContainerPort: 8080, Protocol: "tcp"}}},
+		{"[::1]:80:8080", []PortSpec{{BindIP: "::1", HostPort: 80, ContainerPort: 8080, Protocol: "tcp"}}},
+		{"8000-8002", []PortSpec{
+			{ContainerPort: 8000, Protocol: "tcp"},
+			{ContainerPort: 8001, Protocol: "tcp"},
+			{ContainerPort: 8002, Protocol: "tcp"},
+		}},
+		{"9000-9001:8000-8001/UDP", []PortSpec{
+			{HostPort: 9000, ContainerPort: 8000, Protocol: "udp"},
+			{HostPort: 9001, ContainerPort: 8001, Protocol: "udp"},
+		}},
+
+		// Mismatched ranges
+		{"9000-9002:8000-8001", nil},
+		{"9000:8000-8001", nil},
+		{"8001-8000", nil},
+
+		// Ranges too large
+		{"1-65535", nil},
+		{"1-65535:1-65535", nil},
+
+		// Malformed definitions
+		{"", nil},
+		{"/tcp", nil},
+		{"8080/", nil},
+		{"http", nil},
+		{"0", nil},
+		{"65536", nil},
+		{"80:", nil},
+		{"1.2.3.4:8080", nil},
+		{"a.b.c.d:80:8080", nil},
+		{"1.2.3.4:80:8080:90", nil},
+		{"[::1:80:8080", nil},
+		{"[::1]:8080:90:100", nil},
+		{"8000-", nil},
+		{"-8000", nil},
+	}
+
+	for _, test := range tests {
+		specs, err := ParsePortSpec(test.def)
+		if test.specs == nil {
+			if err == nil {
+				t.Errorf("ParsePortSpec(%q) = %v, expected an error", test.def, specs)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParsePortSpec(%q) failed: %v", test.def, err)
+			continue
+		}
+		if !reflect.DeepEqual(specs, test.specs) {
+			t.Errorf("ParsePortSpec(%q) = %v, expected %v", test.def, specs, test.specs)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"github.com/waynz0r/rancher-consul-registrator/metrics"
+)
+
+var (
+	syncDuration = metrics.NewHistogram(
+		"rancher_consul_registrator_sync_duration_seconds",
+		"Duration of the sync attempts",
+		metrics.DefaultBuckets,
+		"environment",
+	)
+	syncErrors = metrics.NewCounter(
+		"rancher_consul_registrator_sync_errors_total",
+		"Number of failed sync attempts by phase",
+		"environment",
+		"phase",
+	)
+	registrations = metrics.NewCounter(
+		"rancher_consul_registrator_registrations_total",
+		"Number of nodes and services registered to Consul",
+		"environment",
+	)
+	deregistrations = metrics.NewCounter(
+		"rancher_consul_registrator_deregistrations_total",
+		"Number of nodes and services deregistered from Consul",
+		"environment",
+	)
+	catalogDrifts = metrics.NewCounter(
+		"rancher_consul_registrator_catalog_drifts_total",
+		"Number of out-of-band changes to the nodes and services in the catalog",
+		"environment",
+	)
+	heldDeregistrations = metrics.NewGauge(
+		"rancher_consul_registrator_held_deregistrations",
+		"Number of deregistrations held back for being over the threshold",
+		"environment",
+	)
+	managedNodes = metrics.NewGauge(
+		"rancher_consul_registrator_managed_nodes",
+		"Number of Consul nodes managed by the registrator",
+		"environment",
+	)
+	managedServices = metrics.NewGauge(
+		"rancher_consul_registrator_managed_services",
+		"Number of Consul services managed by the registrator",
+		"environment",
+	)
+	lastSuccessfulSync = metrics.NewGauge(
+		"rancher_consul_registrator_last_successful_sync_timestamp_seconds",
+		"Unix timestamp of the last successful sync",
+		"environment",
+	)
+)
@@ -0,0 +1,299 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	// DefaultBuckets are the histogram buckets used for durations, in seconds
+	DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+	registry = &Registry{}
+
+	// Escaping of the text format, label values escape double quotes as well
+	helpEscaper  = strings.NewReplacer("\\", "\\\\", "\n", "\\n")
+	labelEscaper = strings.NewReplacer("\\", "\\\\", "\n", "\\n", "\"", "\\\"")
+)
+
+// Registry holds metrics and writes them in the Prometheus text format
+type Registry struct {
+	mu      sync.Mutex
+	metrics []metric
+}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+func (r *Registry) register(m metric) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.metrics = append(r.metrics, m)
+}
+
+// writeTo writes every registered metric to w
+func (r *Registry) writeTo(w io.Writer) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, m := range r.metrics {
+		m.write(w)
+	}
+}
+
+// Handler serves the metrics of the default registry
+func Handler() http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		registry.writeTo(w)
+	})
+}
+
+// vec holds the values of a metric per label values
+type vec struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newVec(name string, help string, kind string, labels []string) *vec {
+
+	return &vec{
+		name:   name,
+		help:   help,
+		kind:   kind,
+		labels: labels,
+		values: make(map[string]float64),
+	}
+}
+
+func (v *vec) key(labelValues []string) string {
+
+	if len(labelValues) != len(v.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", v.name, len(v.labels), len(labelValues)))
+	}
+
+	return strings.Join(labelValues, "\xff")
+}
+
+func (v *vec) add(delta float64, labelValues []string) {
+
+	k := v.key(labelValues)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.values[k] += delta
+}
+
+func (v *vec) set(value float64, labelValues []string) {
+
+	k := v.key(labelValues)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.values[k] = value
+}
+
+func (v *vec) write(w io.Writer) {
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", v.name, helpEscaper.Replace(v.help), v.name, v.kind)
+	for _, k := range sortedKeys(v.values) {
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, k, "", ""), formatValue(v.values[k]))
+	}
+}
+
+// Counter is a metric that only goes up
+type Counter struct {
+	*vec
+}
+
+// NewCounter registers a new counter with the given label names
+func NewCounter(name string, help string, labels ...string) *Counter {
+
+	c := &Counter{newVec(name, help, "counter", labels)}
+	registry.register(c)
+	return c
+}
+
+// Inc increments the counter for the given label values by one
+func (c *Counter) Inc(labelValues ...string) {
+	c.add(1, labelValues)
+}
+
+// Add increments the counter for the given label values by delta
+func (c *Counter) Add(delta float64, labelValues ...string) {
+
+	if delta < 0 {
+		return
+	}
+	c.add(delta, labelValues)
+}
+
+// Gauge is a metric that can go up and down
+type Gauge struct {
+	*vec
+}
+
+// NewGauge registers a new gauge with the given label names
+func NewGauge(name string, help string, labels ...string) *Gauge {
+
+	g := &Gauge{newVec(name, help, "gauge", labels)}
+	registry.register(g)
+	return g
+}
+
+// Set sets the gauge for the given label values
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.set(value, labelValues)
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+
+	mu     sync.Mutex
+	series map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// NewHistogram registers a new histogram with the given buckets and label names
+func NewHistogram(name string, help string, buckets []float64, labels ...string) *Histogram {
+
+	h := &Histogram{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		series:  make(map[string]*histogramSeries),
+	}
+	registry.register(h)
+	return h
+}
+
+// Observe adds an observation for the given label values
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+
+	if len(labelValues) != len(h.labels) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", h.name, len(h.labels), len(labelValues)))
+	}
+	k := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[k]
+	if !ok {
+		s = &histogramSeries{counts: make([]uint64, len(h.buckets))}
+		h.series[k] = s
+	}
+
+	for i, b := range h.buckets {
+		if value <= b {
+			s.counts[i]++
+		}
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *Histogram) write(w io.Writer) {
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, helpEscaper.Replace(h.help), h.name)
+
+	keys := make([]string, 0, len(h.series))
+	for k := range h.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		s := h.series[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", formatValue(b)), s.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, k, "le", "+Inf"), s.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, k, "", ""), formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, k, "", ""), s.count)
+	}
+}
+
+func sortedKeys(values map[string]float64) []string {
+
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders the label pairs of a series, with an optional extra pair
+func formatLabels(names []string, key string, extraName string, extraValue string) string {
+
+	var pairs []string
+
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+		for i, name := range names {
+			pairs = append(pairs, name+"="+quoteLabel(values[i]))
+		}
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, extraName+"="+quoteLabel(extraValue))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// quoteLabel quotes a label value the way the text format expects
+func quoteLabel(value string) string {
+	return "\"" + labelEscaper.Replace(value) + "\""
+}
+
+func formatValue(v float64) string {
+
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
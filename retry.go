@@ -0,0 +1,60 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+var (
+	statusCodeRe = regexp.MustCompile(`(?:response code: |Error )(\d{3})`)
+)
+
+// SyncError is an error raised during a given phase of a sync
+type SyncError struct {
+	Phase string
+	Err   error
+}
+
+func (e *SyncError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Phase, e.Err)
+}
+
+// Transient reports whether the sync is worth retrying. Client errors
+// (bad token, ACL denied, missing path) won't fix themselves, anything
+// else (network errors, 5xx, leader elections) is considered transient.
+func (e *SyncError) Transient() bool {
+	m := statusCodeRe.FindStringSubmatch(e.Err.Error())
+	if m == nil {
+		return true
+	}
+
+	code, _ := strconv.Atoi(m[1])
+	switch {
+	case code == 408 || code == 429:
+		return true
+	case code >= 400 && code < 500:
+		return false
+	}
+
+	return true
+}
+
+// backoff returns the delay before the given retry attempt (starting at 0),
+// growing exponentially up to max with full jitter applied
+func backoff(attempt int, base time.Duration, max time.Duration) time.Duration {
+	d := base
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	if d <= 0 {
+		return 0
+	}
+
+	return time.Duration(rand.Int63n(int64(d)) + 1)
+}
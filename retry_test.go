@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSyncErrorTransient(t *testing.T) {
+
+	tests := []struct {
+		err       string
+		transient bool
+	}{
+		// Network errors and server side failures
+		{"dial tcp 10.0.0.1:8500: connect: connection refused", true},
+		{"Get http://rancher-metadata/latest/containers: EOF", true},
+		{"Unexpected response code: 500 (rpc error: No cluster leader)", true},
+		{"Unexpected response code: 503 (service unavailable)", true},
+		{"Error 502 Bad Gateway", true},
+
+		// Throttling and timeouts
+		{"Unexpected response code: 429 (too many requests)", true},
+		{"Unexpected response code: 408 (request timeout)", true},
+
+		// Client errors won't fix themselves
+		{"Unexpected response code: 403 (Permission denied)", false},
+		{"Unexpected response code: 400 (Invalid service address)", false},
+		{"Error 404 Not Found", false},
+	}
+
+	for _, test := range tests {
+		err := &SyncError{Phase: "test", Err: errors.New(test.err)}
+		if transient := err.Transient(); transient != test.transient {
+			t.Errorf("Transient() of %q = %v, expected %v", test.err, transient, test.transient)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+
+	base, max := 100*time.Millisecond, time.Second
+
+	for attempt, limit := range []time.Duration{100, 200, 400, 800, 1000, 1000, 1000} {
+		limit *= time.Millisecond
+		for i := 0; i < 100; i++ {
+			if d := backoff(attempt, base, max); d <= 0 || d > limit {
+				t.Fatalf("backoff(%d) = %v, expected it in (0, %v]", attempt, d, limit)
+			}
+		}
+	}
+
+	if d := backoff(100, base, max); d <= 0 || d > max {
+		t.Errorf("backoff(100) = %v, expected it in (0, %v]", d, max)
+	}
+	if d := backoff(3, 0, max); d != 0 {
+		t.Errorf("backoff without base delay = %v, expected 0", d)
+	}
+}